@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Version suffix of an API set contract name, such as -l1-2-0
+var apiSetVersion = regexp.MustCompile(`-l\d+-\d+-\d+$`)
+
+// Host DLLs of the API set contracts, from the schema of Windows 7 to 10. Contracts are listed
+// without their version, so api-ms-win-core-synch-l1-1-0 and -l1-2-0 both resolve to kernel32.dll.
+// Where newer Windows moved a contract to kernelbase.dll or combase.dll, the DLL that hosted the
+// functions before lists it, since that is the DLL progwrp replaces.
+var apiSetHosts = []struct {
+	host      string
+	contracts string
+}{
+	{"kernel32.dll", `api-ms-win-core-atoms api-ms-win-core-calendar api-ms-win-core-comm
+		api-ms-win-core-console api-ms-win-core-datetime api-ms-win-core-debug api-ms-win-core-delayload
+		api-ms-win-core-errorhandling api-ms-win-core-fibers api-ms-win-core-file api-ms-win-core-firmware
+		api-ms-win-core-handle api-ms-win-core-heap api-ms-win-core-heap-obsolete api-ms-win-core-interlocked
+		api-ms-win-core-io api-ms-win-core-job api-ms-win-core-kernel32-legacy api-ms-win-core-kernel32-private
+		api-ms-win-core-largeinteger api-ms-win-core-libraryloader api-ms-win-core-localization
+		api-ms-win-core-localization-obsolete api-ms-win-core-memory api-ms-win-core-namedpipe
+		api-ms-win-core-namespace api-ms-win-core-normalization api-ms-win-core-path
+		api-ms-win-core-privateprofile api-ms-win-core-processenvironment api-ms-win-core-processsnapshot
+		api-ms-win-core-processthreads api-ms-win-core-processtopology api-ms-win-core-processtopology-obsolete
+		api-ms-win-core-profile api-ms-win-core-psapi api-ms-win-core-psapi-ansi api-ms-win-core-realtime
+		api-ms-win-core-sidebyside api-ms-win-core-string api-ms-win-core-string-obsolete
+		api-ms-win-core-synch api-ms-win-core-sysinfo api-ms-win-core-systemtopology
+		api-ms-win-core-threadpool api-ms-win-core-threadpool-legacy api-ms-win-core-threadpool-private
+		api-ms-win-core-timezone api-ms-win-core-toolhelp api-ms-win-core-util api-ms-win-core-windowserrorreporting
+		api-ms-win-core-wow64 api-ms-win-core-xstate ext-ms-win-kernel32-package
+		ext-ms-win-kernel32-package-current`},
+	{"ntdll.dll", `api-ms-win-core-rtlsupport api-ms-win-core-apiquery ext-ms-win-ntdll`},
+	{"advapi32.dll", `api-ms-win-core-localregistry api-ms-win-core-registry api-ms-win-downlevel-advapi32
+		api-ms-win-eventing-classicprovider api-ms-win-eventing-consumer api-ms-win-eventing-controller
+		api-ms-win-eventing-legacy api-ms-win-eventing-obsolete api-ms-win-eventing-provider
+		api-ms-win-security-activedirectoryclient api-ms-win-security-base api-ms-win-security-credentials
+		api-ms-win-security-cryptoapi api-ms-win-security-lsalookup api-ms-win-security-lsapolicy
+		api-ms-win-security-provider api-ms-win-security-sddl api-ms-win-security-trustee
+		api-ms-win-service-core api-ms-win-service-management api-ms-win-service-private
+		api-ms-win-service-winsvc ext-ms-win-advapi32-registry ext-ms-win-advapi32-psm-app`},
+	{"user32.dll", `api-ms-win-downlevel-user32 api-ms-win-ntuser-dc-access api-ms-win-ntuser-sysparams
+		api-ms-win-rtcore-ntuser-private api-ms-win-rtcore-ntuser-window api-ms-win-rtcore-ntuser-synch
+		ext-ms-win-ntuser-dialogbox ext-ms-win-ntuser-draw ext-ms-win-ntuser-gui ext-ms-win-ntuser-keyboard
+		ext-ms-win-ntuser-message ext-ms-win-ntuser-misc ext-ms-win-ntuser-mouse ext-ms-win-ntuser-private
+		ext-ms-win-ntuser-rectangle ext-ms-win-ntuser-sysparams ext-ms-win-ntuser-uicontext
+		ext-ms-win-ntuser-window ext-ms-win-ntuser-windowclass ext-ms-win-ntuser-windowstation
+		ext-ms-win-rtcore-ntuser-cursor ext-ms-win-rtcore-ntuser-dc-access ext-ms-win-rtcore-ntuser-iam
+		ext-ms-win-rtcore-ntuser-rawinput ext-ms-win-rtcore-ntuser-syscolors
+		ext-ms-win-rtcore-ntuser-sysparams ext-ms-win-rtcore-ntuser-window ext-ms-win-rtcore-ntuser-winevent`},
+	{"gdi32.dll", `ext-ms-win-gdi-dc ext-ms-win-gdi-dc-create ext-ms-win-gdi-devcaps ext-ms-win-gdi-draw
+		ext-ms-win-gdi-font ext-ms-win-gdi-metafile ext-ms-win-gdi-path ext-ms-win-gdi-print
+		ext-ms-win-gdi-private ext-ms-win-gdi-render ext-ms-win-gdi-rgn ext-ms-win-rtcore-gdi-devcaps
+		ext-ms-win-rtcore-gdi-object ext-ms-win-rtcore-gdi-rgn`},
+	{"shlwapi.dll", `api-ms-win-core-shlwapi-legacy api-ms-win-core-shlwapi-obsolete api-ms-win-core-url
+		api-ms-win-downlevel-shlwapi api-ms-win-shcore-obsolete api-ms-win-shcore-path
+		api-ms-win-shcore-registry api-ms-win-shcore-stream api-ms-win-shcore-thread ext-ms-win-shell-shlwapi`},
+	{"shcore.dll", `api-ms-win-shcore-scaling api-ms-win-shcore-sysinfo api-ms-win-shcore-taskpool
+		api-ms-win-shcore-unicodeansi`},
+	{"shell32.dll", `api-ms-win-shell-shellcom api-ms-win-shell-shellfolders ext-ms-win-shell-shell32
+		ext-ms-win-shell32-shellcom ext-ms-win-shell32-shellfolders`},
+	{"ole32.dll", `api-ms-win-core-com api-ms-win-core-com-midlproxystub api-ms-win-core-com-private
+		api-ms-win-core-marshal api-ms-win-downlevel-ole32 ext-ms-win-ole32-bindctx ext-ms-win-ole32-ie-ext
+		ext-ms-win-ole32-oleautomation`},
+	{"combase.dll", `api-ms-win-core-winrt api-ms-win-core-winrt-error api-ms-win-core-winrt-errorprivate
+		api-ms-win-core-winrt-registration api-ms-win-core-winrt-robuffer api-ms-win-core-winrt-roparameterizediid
+		api-ms-win-core-winrt-string`},
+	{"version.dll", `api-ms-win-core-version api-ms-win-core-versionansi api-ms-win-downlevel-version`},
+	{"powrprof.dll", `api-ms-win-power-base api-ms-win-power-limitsmanagement api-ms-win-power-setting
+		ext-ms-win-power-base`},
+	{"userenv.dll", `api-ms-win-downlevel-userenv ext-ms-win-profile-profsvc ext-ms-win-profile-userenv`},
+	{"bcrypt.dll", `api-ms-win-security-bcrypt ext-ms-win-security-bcrypt`},
+	{"crypt32.dll", `ext-ms-win-security-cryptui ext-ms-win-crypto-crypt32 ext-ms-win-security-crypt32`},
+	{"ws2_32.dll", `ext-ms-win-networking-winsock`},
+	{"iphlpapi.dll", `ext-ms-win-networking-iphlpapi`},
+	{"winhttp.dll", `ext-ms-win-networking-winhttp`},
+	{"dwmapi.dll", `ext-ms-win-dwmapi-ext`},
+	{"setupapi.dll", `ext-ms-win-setupapi-cfgmgr32local ext-ms-win-setupapi-classinstallers
+		ext-ms-win-setupapi-inf ext-ms-win-setupapi-logging`},
+	{"cfgmgr32.dll", `api-ms-win-devices-config ext-ms-win-devices-config`},
+	{"dnsapi.dll", `ext-ms-win-networking-dnsapi`},
+	{"wevtapi.dll", `api-ms-win-eventlog-legacy ext-ms-win-eventing-wevtapi`},
+	{"ucrtbase.dll", `api-ms-win-crt-conio api-ms-win-crt-convert api-ms-win-crt-environment
+		api-ms-win-crt-filesystem api-ms-win-crt-heap api-ms-win-crt-locale api-ms-win-crt-math
+		api-ms-win-crt-multibyte api-ms-win-crt-private api-ms-win-crt-process api-ms-win-crt-runtime
+		api-ms-win-crt-stdio api-ms-win-crt-string api-ms-win-crt-time api-ms-win-crt-utility`},
+}
+
+// Host DLL of each versionless contract name
+var apiSetSchema = make(map[string]string)
+
+func init() {
+	for _, hosts := range apiSetHosts {
+		for _, contract := range strings.Fields(hosts.contracts) {
+			apiSetSchema[contract] = hosts.host
+		}
+	}
+}
+
+// isAPISet reports whether a DLL name is an API set contract
+func isAPISet(dll string) bool {
+	lower := strings.ToLower(dll)
+	for _, prefix := range apiSetPrefixes {
+		if strings.HasPrefix(lower, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// apiSetContract strips the extension and version from a contract name,
+// api-ms-win-core-synch-l1-2-0.dll becomes api-ms-win-core-synch
+func apiSetContract(dll string) string {
+	lower := strings.ToLower(dll)
+	lower = strings.TrimSuffix(lower, ".dll")
+	return apiSetVersion.ReplaceAllString(lower, "")
+}
+
+// apiSetHost returns the host DLL of an API set contract, or "" for unknown contracts and
+// names that are not contracts
+func apiSetHost(dll string) string {
+	if !isAPISet(dll) {
+		return ""
+	}
+	return apiSetSchema[apiSetContract(dll)]
+}
+
+// reportContracts prints the API set contracts a binary imports that cannot be resolved on a
+// target older than Windows 7, which has no API set schema
+func reportContracts(path string, descs []importDescriptor) {
+	if !targetVersion.before(win7) {
+		return
+	}
+	seen := make(map[string]bool)
+	for _, desc := range descs {
+		lower := strings.ToLower(desc.Name)
+		if !isAPISet(desc.Name) || seen[lower] {
+			continue
+		}
+		seen[lower] = true
+		if _, ok := replacementFor(desc.Name); ok {
+			continue
+		}
+		if host := apiSetHost(desc.Name); host != "" {
+			fmt.Printf("warning: %s imports %s, its host %s has no mapping so it will not resolve on %s\n", path, desc.Name, host, targetVersion)
+		} else {
+			fmt.Printf("warning: %s imports %s, an unknown API set contract that will not resolve on %s\n", path, desc.Name, targetVersion)
+		}
+	}
+}
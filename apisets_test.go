@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	pefile "github.com/saferwall/pe"
+)
+
+func TestAPISetHost(t *testing.T) {
+	tests := map[string]string{
+		"api-ms-win-core-synch-l1-2-0.dll":          "kernel32.dll",
+		"API-MS-WIN-CORE-SYNCH-L1-1-0.DLL":          "kernel32.dll",
+		"api-ms-win-core-synch-l1-2-0":              "kernel32.dll",
+		"api-ms-win-core-shlwapi-legacy-l1-1-0.dll": "shlwapi.dll",
+		"ext-ms-win-gdi-render-l1-1-0.dll":          "gdi32.dll",
+		"api-ms-win-core-does-not-exist-l1-1-0.dll": "",
+		"kernel32.dll":              "",
+		"api-ms-win-core-synch.dll": "kernel32.dll",
+	}
+	for dll, want := range tests {
+		if got := apiSetHost(dll); got != want {
+			t.Errorf("apiSetHost(%q) = %q, want %q", dll, got, want)
+		}
+	}
+}
+
+func TestAPISetContract(t *testing.T) {
+	tests := map[string]string{
+		"api-ms-win-core-synch-l1-2-0.dll":   "api-ms-win-core-synch",
+		"api-ms-win-core-path-l1-1-0.dll":    "api-ms-win-core-path",
+		"api-ms-win-crt-runtime-l1-1-0.dll":  "api-ms-win-crt-runtime",
+		"api-ms-win-core-synch-l1-2-0-x.dll": "api-ms-win-core-synch-l1-2-0-x",
+	}
+	for dll, want := range tests {
+		if got := apiSetContract(dll); got != want {
+			t.Errorf("apiSetContract(%q) = %q, want %q", dll, got, want)
+		}
+	}
+}
+
+func TestReportContracts(t *testing.T) {
+	newTestDir(t)
+	mapping["kernel32.dll"] = "pwrp_k32.dll"
+	descs := []importDescriptor{
+		{Name: "api-ms-win-core-synch-l1-2-0.dll"},
+		{Name: "api-ms-win-core-synch-l1-2-0.dll", Delay: true},
+		{Name: "ext-ms-win-gdi-render-l1-1-0.dll"},
+		{Name: "api-ms-win-core-unknown-l1-1-0.dll"},
+		{Name: "user32.dll", Functions: []pefile.ImportFunction{{Name: "MessageBoxA"}}},
+	}
+
+	out := captureOutput(t, func() { reportContracts("app.exe", descs) })
+	want := []string{
+		"warning: app.exe imports ext-ms-win-gdi-render-l1-1-0.dll, its host gdi32.dll has no mapping so it will not resolve on 5.1",
+		"warning: app.exe imports api-ms-win-core-unknown-l1-1-0.dll, an unknown API set contract that will not resolve on 5.1",
+	}
+	if got := strings.Split(strings.TrimSpace(out), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("output:\n%s\nwant:\n%s", out, strings.Join(want, "\n"))
+	}
+
+	// Windows 7 resolves contracts itself
+	targetVersion = win7
+	if out := captureOutput(t, func() { reportContracts("app.exe", descs) }); out != "" {
+		t.Errorf("output on Windows 7:\n%s", out)
+	}
+}
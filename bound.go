@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// unbindImports invalidates pre-resolved imports. Bound addresses belong to the DLLs imported
+// before patching, so the bound import directory is zeroed, every descriptor is marked unbound
+// and each IAT is restored from its lookup table for the loader to fill in again.
+func unbindImports(data []byte, descs []importDescriptor) error {
+	l, err := parseLayout(data)
+	if err != nil {
+		return err
+	}
+	is64 := l.magic == 0x20b
+	thunkSize := uint32(4)
+	if is64 {
+		thunkSize = 8
+	}
+
+	if boundOffset, boundSize := l.directory(data, dirBoundImport); boundSize != 0 {
+		// The directory lives in the headers, where RVAs and file offsets are the same
+		sizeOfHeaders := binary.LittleEndian.Uint32(data[l.field(60):])
+		if boundOffset+boundSize <= sizeOfHeaders && int(boundOffset+boundSize) <= len(data) {
+			for i := boundOffset; i < boundOffset+boundSize; i++ {
+				data[i] = 0
+			}
+		}
+		l.setDirectory(data, dirBoundImport, 0, 0)
+		fmt.Printf("cleared bound import directory (%d bytes)\n", boundSize)
+	}
+
+	for _, desc := range descs {
+		if desc.Delay {
+			// Delay-load helpers only use the bound IAT while TimeDateStamp matches the DLL
+			if binary.LittleEndian.Uint32(data[desc.Offset+28:]) != 0 {
+				binary.LittleEndian.PutUint32(data[desc.Offset+28:], 0)
+				fmt.Printf("unbound delay-load import: %s\n", desc.Name)
+			}
+			continue
+		}
+
+		raw := data[desc.Offset : desc.Offset+importDescriptorSize]
+		if binary.LittleEndian.Uint32(raw[4:]) == 0 {
+			continue
+		}
+		originalFirstThunk := binary.LittleEndian.Uint32(raw[0:])
+		firstThunk := binary.LittleEndian.Uint32(raw[16:])
+		if originalFirstThunk == 0 {
+			return fmt.Errorf("%s is bound but has no import lookup table to restore its IAT from", desc.Name)
+		}
+		lookupOffset, err := rvaToOffset(data, originalFirstThunk)
+		if err != nil {
+			return fmt.Errorf("import lookup table of %s: %v", desc.Name, err)
+		}
+		iatOffset, err := rvaToOffset(data, firstThunk)
+		if err != nil {
+			return fmt.Errorf("IAT of %s: %v", desc.Name, err)
+		}
+		for i := uint32(0); int(lookupOffset+i+thunkSize) <= len(data) && int(iatOffset+i+thunkSize) <= len(data); i += thunkSize {
+			copy(data[iatOffset+i:iatOffset+i+thunkSize], data[lookupOffset+i:lookupOffset+i+thunkSize])
+			if readThunk(data, lookupOffset+i, is64) == 0 {
+				break
+			}
+		}
+		binary.LittleEndian.PutUint32(raw[4:], 0) // TimeDateStamp
+		binary.LittleEndian.PutUint32(raw[8:], 0) // ForwarderChain
+		fmt.Printf("unbound import: %s\n", desc.Name)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+)
+
+// bindFixture marks every import descriptor of a fixture as bound and fills its IAT with
+// addresses, as BIND.EXE does
+func bindFixture(t *testing.T, path string) {
+	t.Helper()
+	data := readFixture(t, path)
+	pe, err := parsePE(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	is64 := pe.Is64
+	descs := importDescriptors(pe)
+	pe.Close()
+	thunkSize := uint32(4)
+	if is64 {
+		thunkSize = 8
+	}
+	for _, desc := range descs {
+		raw := data[desc.Offset : desc.Offset+importDescriptorSize]
+		binary.LittleEndian.PutUint32(raw[4:], 0xffffffff)
+		binary.LittleEndian.PutUint32(raw[8:], 0xffffffff)
+		iat, err := rvaToOffset(data, binary.LittleEndian.Uint32(raw[16:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range desc.Functions {
+			copy(data[iat+uint32(i)*thunkSize:], appendThunk(nil, 0x7c800000+uint64(i)*0x10, is64))
+		}
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnbindImports(t *testing.T) {
+	for _, is64 := range []bool{false, true} {
+		t.Run(fixtureArch(is64), func(t *testing.T) {
+			dir := newTestDir(t)
+			mapping["kernel32.dll"] = "pwrp_k32.dll"
+			writeFixture(t, blobsBaseDir, fixtureArch(is64)+"/pwrp_k32.dll", fxSpec{Is64: is64, Dll: true,
+				Name: "pwrp_k32.dll", Exports: []fxExport{{Name: "GetTickCount"}, {Name: "Sleep"}}})
+			app := writeFixture(t, dir, "app.exe", fxSpec{Is64: is64, BoundTo: []string{"kernel32.dll", "user32.dll"},
+				Imports: []fxImport{
+					{DLL: "kernel32.dll", Funcs: []string{"GetTickCount", "Sleep"}},
+					{DLL: "user32.dll", Funcs: []string{"MessageBoxA"}},
+				}})
+			bindFixture(t, app)
+			original := readFixture(t, app)
+			ol, err := parseLayout(original)
+			if err != nil {
+				t.Fatal(err)
+			}
+			boundOffset, boundSize := ol.directory(original, dirBoundImport)
+			if boundSize == 0 {
+				t.Fatal("fixture has no bound import directory")
+			}
+
+			out := patchFixture(t, app)
+			data := readFixture(t, out)
+			l, err := parseLayout(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if offset, size := l.directory(data, dirBoundImport); offset != 0 || size != 0 {
+				t.Errorf("bound import directory = 0x%x, %d", offset, size)
+			}
+			if !bytes.Equal(data[boundOffset:boundOffset+boundSize], make([]byte, boundSize)) {
+				t.Errorf("bound import directory was not cleared")
+			}
+
+			// Unmapped DLLs are unbound too, their bound addresses may have moved with the new imports
+			pe, err := parsePE(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pe.Close()
+			thunkSize := uint32(4)
+			if is64 {
+				thunkSize = 8
+			}
+			for _, desc := range importDescriptors(pe) {
+				raw := data[desc.Offset : desc.Offset+importDescriptorSize]
+				if stamp, chain := binary.LittleEndian.Uint32(raw[4:]), binary.LittleEndian.Uint32(raw[8:]); stamp != 0 || chain != 0 {
+					t.Errorf("%s: TimeDateStamp 0x%x, ForwarderChain 0x%x", desc.Name, stamp, chain)
+				}
+				lookup, _ := rvaToOffset(data, binary.LittleEndian.Uint32(raw[0:]))
+				iat, _ := rvaToOffset(data, binary.LittleEndian.Uint32(raw[16:]))
+				n := uint32(len(desc.Functions)+1) * thunkSize
+				if !bytes.Equal(data[iat:iat+n], data[lookup:lookup+n]) {
+					t.Errorf("%s: IAT was not restored from the lookup table", desc.Name)
+				}
+			}
+		})
+	}
+}
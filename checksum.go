@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// Offset of CheckSum in the optional header (same for PE32 and PE32+)
+const checksumField = 64
+
+// Write a zero CheckSum instead of recomputing it
+var zeroChecksum bool
+
+// peChecksum computes the optional header CheckSum the way imagehlp's CheckSumMappedFile does:
+// a 16-bit one's complement style sum over the file with the CheckSum field itself skipped,
+// plus the file length
+func peChecksum(data []byte, checksumOffset uint32) uint32 {
+	var sum uint32
+	for i := 0; i < len(data); i += 2 {
+		if uint32(i) == checksumOffset || uint32(i) == checksumOffset+2 {
+			continue
+		}
+		word := uint32(data[i])
+		if i+1 < len(data) {
+			word |= uint32(data[i+1]) << 8
+		}
+		sum += word
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	sum = (sum & 0xffff) + (sum >> 16)
+	return sum + uint32(len(data))
+}
+
+// updateChecksum recomputes (or zeroes, with -zero-checksum) the CheckSum of a written file.
+// It has to run after every other change to the file.
+func updateChecksum(filePath string, debug bool) error {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %v", err)
+	}
+	l, err := parseLayout(data)
+	if err != nil {
+		return err
+	}
+	offset := l.field(checksumField)
+	old := binary.LittleEndian.Uint32(data[offset:])
+
+	var checksum uint32
+	if !zeroChecksum {
+		checksum = peChecksum(data, offset)
+	}
+	if debug {
+		fmt.Printf("[DEBUG] CheckSum at 0x%x: 0x%08x -> 0x%08x\n", offset, old, checksum)
+	}
+	if checksum == old {
+		return nil
+	}
+	binary.LittleEndian.PutUint32(data[offset:], checksum)
+	if err := os.WriteFile(filePath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write checksum: %v", err)
+	}
+	if zeroChecksum {
+		fmt.Printf("cleared checksum (was 0x%08x)\n", old)
+	} else {
+		fmt.Printf("updated checksum 0x%08x -> 0x%08x\n", old, checksum)
+	}
+	return nil
+}
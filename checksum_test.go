@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// Expected values were computed with an independent implementation of CheckSumMappedFile
+func TestPEChecksum(t *testing.T) {
+	tests := []struct {
+		name string
+		spec fxSpec
+		want uint32
+	}{
+		{"PE32 with odd sized overlay", fxSpec{Checksum: 0xdeadbeef, Overlay: []byte("odd"),
+			Imports: []fxImport{{DLL: "kernel32.dll", Funcs: []string{"GetTickCount"}}}}, 0x0000fc6f},
+		{"PE32+ DLL", fxSpec{Is64: true, Dll: true, Name: "a.dll", Exports: []fxExport{{Name: "F"}},
+			Imports: []fxImport{{DLL: "kernel32.dll", Funcs: []string{"GetTickCount"}}}}, 0x0000ebbc},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := buildPE(tt.spec)
+			l, err := parseLayout(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := peChecksum(data, l.field(checksumField)); got != tt.want {
+				t.Errorf("peChecksum = 0x%08x, want 0x%08x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPEChecksumFoldsCarry(t *testing.T) {
+	data := []byte{0xff, 0xff, 0xff, 0xff, 0x12, 0x34, 0x56, 0x78}
+	// 0xffff + 0xffff folds to 0xffff, the skipped field does not count, plus 8 bytes
+	if got := peChecksum(data, 4); got != 0x10007 {
+		t.Errorf("peChecksum = 0x%08x, want 0x00010007", got)
+	}
+}
+
+func TestUpdateChecksum(t *testing.T) {
+	for _, is64 := range []bool{false, true} {
+		t.Run(fixtureArch(is64), func(t *testing.T) {
+			dir := newTestDir(t)
+			path := writeFixture(t, dir, "app.exe", fxSpec{Is64: is64, Checksum: 0x1234})
+			if err := updateChecksum(path, false); err != nil {
+				t.Fatal(err)
+			}
+			data := readFixture(t, path)
+			l, err := parseLayout(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			offset := l.field(checksumField)
+			if got, want := binary.LittleEndian.Uint32(data[offset:]), peChecksum(data, offset); got != want || got == 0x1234 {
+				t.Errorf("CheckSum = 0x%08x, want 0x%08x", got, want)
+			}
+
+			zeroChecksum = true
+			if err := updateChecksum(path, false); err != nil {
+				t.Fatal(err)
+			}
+			if got := binary.LittleEndian.Uint32(readFixture(t, path)[offset:]); got != 0 {
+				t.Errorf("CheckSum = 0x%08x with -zero-checksum", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Default mapping built into the executable, so the patcher works from any directory
+//
+//go:embed progwrp.ini
+var defaultIni []byte
+
+// Name of the mapping file looked up in the standard locations
+const iniFileName = "progwrp.ini"
+
+// Source name of the built-in mapping in messages
+const embeddedIniName = "built-in progwrp.ini"
+
+// Sections in the order they were first seen across all layers
+var mappingSections []string
+
+// Files (with line) each section was read from, by lowercase section name
+var sectionSources = make(map[string][]string)
+
+// addSectionSource records where a section header was read
+func addSectionSource(section, name string, line int) {
+	if _, ok := sectionSources[section]; !ok {
+		mappingSections = append(mappingSections, section)
+	}
+	sectionSources[section] = append(sectionSources[section], fmt.Sprintf("%s:%d", name, line))
+}
+
+// resetMapping clears everything loaded from ini files
+func resetMapping() {
+	mapping = make(map[string]string)
+	mappingPatterns = nil
+	mappingConditions = make(map[string]*mappingCondition)
+	splitFunctions = make(map[string]map[string]bool)
+	mappingSections = nil
+	sectionSources = make(map[string][]string)
+}
+
+// userIniPaths returns the standard locations of user overrides in the order they are layered:
+// next to the executable, then in the user config directory
+func userIniPaths() []string {
+	var paths []string
+	if exePath, err := os.Executable(); err == nil {
+		paths = append(paths, filepath.Join(filepath.Dir(exePath), iniFileName))
+	}
+	if configDir, err := os.UserConfigDir(); err == nil {
+		paths = append(paths, filepath.Join(configDir, "progwrp-patcher", iniFileName))
+	}
+	return paths
+}
+
+// SHA-256 over the contents of every mapping layer, in the order they were loaded
+var mappingHash string
+
+// layerIniFile parses an ini file over the mapping loaded so far and adds its contents to h.
+// Errors reading the file are returned as they are, so callers can tell a missing file apart.
+func layerIniFile(p string, h hash.Hash) error {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	h.Write(data)
+	return parseIni(p, bytes.NewReader(data))
+}
+
+// loadedFrom reports whether a file is one of the loaded ini layers
+func loadedFrom(sources []string, p string) bool {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return false
+	}
+	for _, source := range sources {
+		if sourceAbs, err := filepath.Abs(source); err == nil && sourceAbs == abs {
+			return true
+		}
+	}
+	return false
+}
+
+// loadMapping builds the mapping from the built-in default, the user overrides found in the
+// standard locations and the file given with -ini, each layer overriding keys of the ones
+// before. It returns the sources that were loaded.
+func loadMapping(explicit string) ([]string, error) {
+	resetMapping()
+	h := sha256.New()
+	h.Write(defaultIni)
+	if err := parseIni(embeddedIniName, bytes.NewReader(defaultIni)); err != nil {
+		return nil, err
+	}
+	sources := []string{embeddedIniName}
+
+	for _, p := range userIniPaths() {
+		if err := layerIniFile(p, h); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		sources = append(sources, p)
+	}
+	if explicit != "" {
+		if err := layerIniFile(explicit, h); os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to open ini file: %v", err)
+		} else if err != nil {
+			return nil, err
+		}
+		sources = append(sources, explicit)
+	}
+
+	// Older versions read progwrp.ini from the working directory by default
+	if fileExists(iniFileName) && !loadedFrom(sources, iniFileName) {
+		fmt.Printf("warning: ignoring %s in the current directory, pass -ini %s to use it or move it to %s\n",
+			iniFileName, iniFileName, strings.Join(userIniPaths(), " or "))
+	}
+
+	// A layer may only change some keys of a section, so this is checked on the merged result
+	var problems []string
+	for _, section := range mappingSections {
+		if _, ok := mapping[section]; ok {
+			continue
+		}
+		if _, ok := patternReplacement(section); !ok {
+			problems = append(problems, fmt.Sprintf("%s: section [%s] has no ReplacementName", sectionSources[section][0], section))
+		}
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid ini file:\n  %s", strings.Join(problems, "\n  "))
+	}
+	mappingHash = hex.EncodeToString(h.Sum(nil))
+	return sources, nil
+}
+
+// printEffectiveMapping writes the merged mapping in ini form, with the files each section came from
+func printEffectiveMapping(sources []string) {
+	fmt.Printf("; effective mapping from %s\n", strings.Join(sources, ", "))
+	for _, section := range mappingSections {
+		fmt.Printf("\n; %s\n[%s]\n", strings.Join(sectionSources[section], ", "), section)
+		if replacement, ok := mapping[section]; ok {
+			fmt.Printf("ReplacementName=%s\n", replacement)
+		} else if replacement, ok := patternReplacement(section); ok {
+			fmt.Printf("ReplacementName=%s\n", replacement)
+		}
+		if functions, ok := splitFunctions[section]; ok {
+			names := make([]string, 0, len(functions))
+			for name := range functions {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			fmt.Printf("Functions=%s\n", strings.Join(names, ","))
+		}
+		if c, ok := mappingConditions[section]; ok {
+			if len(c.Archs) > 0 {
+				fmt.Printf("Arch=%s\n", strings.Join(c.Archs, ","))
+			}
+			if len(c.Targets) > 0 {
+				fmt.Printf("Targets=%s\n", strings.Join(c.Targets, ","))
+			}
+			if !c.Enabled {
+				fmt.Printf("Enabled=false\n")
+			}
+			if c.Note != "" {
+				fmt.Printf("Note=%s\n", c.Note)
+			}
+		}
+	}
+}
+
+// runMappingShow implements mapping show
+func runMappingShow(args []string) error {
+	fs := flag.NewFlagSet("mapping show", flag.ExitOnError)
+	iniPath := fs.String("ini", "", "ini file layered over the built-in mapping and the standard locations")
+	effective := fs.Bool("effective", false, "print the merged mapping of every layer instead of the built-in one")
+	fs.Parse(args)
+
+	if !*effective {
+		os.Stdout.Write(defaultIni)
+		return nil
+	}
+	sources, err := loadMapping(*iniPath)
+	if err != nil {
+		return err
+	}
+	printEffectiveMapping(sources)
+	return nil
+}
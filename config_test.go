@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setUserConfigDir points os.UserConfigDir at dir for the duration of the test
+func setUserConfigDir(t *testing.T, dir string) {
+	t.Helper()
+	for _, key := range []string{"XDG_CONFIG_HOME", "AppData", "HOME"} {
+		old, ok := os.LookupEnv(key)
+		os.Setenv(key, dir)
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(key, old)
+			} else {
+				os.Unsetenv(key)
+			}
+		})
+	}
+}
+
+// chdir changes the working directory for the duration of the test
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestLoadMappingLayersUserOverride(t *testing.T) {
+	dir := newTestDir(t)
+	setUserConfigDir(t, dir)
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	userIni := filepath.Join(configDir, "progwrp-patcher", iniFileName)
+	override := "[kernel32.dll]\nReplacementName=custom_k32.dll\n[ktmw32.dll]\nEnabled=true\n[extra.dll]\nReplacementName=pwrp_extra.dll\n"
+	if err := os.MkdirAll(filepath.Dir(userIni), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(userIni, []byte(override), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sources, err := loadMapping("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 2 || sources[0] != embeddedIniName || sources[1] != userIni {
+		t.Fatalf("sources = %q, want built-in and %s", sources, userIni)
+	}
+	for dll, want := range map[string]string{
+		"kernel32.dll": "custom_k32.dll",
+		"user32.dll":   "p_user.dll",
+		"extra.dll":    "pwrp_extra.dll",
+	} {
+		if got := mapping[dll]; got != want {
+			t.Errorf("mapping[%s] = %q, want %q", dll, got, want)
+		}
+	}
+	// Keys the override does not set are kept from the built-in section
+	if c := mappingConditions["ktmw32.dll"]; c == nil || !c.Enabled || c.Note == "" {
+		t.Errorf("ktmw32.dll condition = %+v, want enabled with the built-in note", c)
+	}
+	if got := sectionSources["kernel32.dll"]; len(got) != 2 || got[1] != userIni+":1" {
+		t.Errorf("kernel32.dll sources = %q", got)
+	}
+
+	h := sha256.New()
+	h.Write(defaultIni)
+	h.Write([]byte(override))
+	if want := hex.EncodeToString(h.Sum(nil)); mappingHash != want {
+		t.Errorf("mappingHash = %s, want %s", mappingHash, want)
+	}
+}
+
+func TestLoadMappingWarnsAboutWorkingDirectoryIni(t *testing.T) {
+	dir := newTestDir(t)
+	setUserConfigDir(t, dir)
+	chdir(t, dir)
+	if err := os.WriteFile(iniFileName, []byte("[kernel32.dll]\nReplacementName=custom_k32.dll\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := captureOutput(t, func() {
+		if _, err := loadMapping(""); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if !strings.Contains(out, "warning: ignoring progwrp.ini in the current directory") {
+		t.Errorf("no warning about ./progwrp.ini in %q", out)
+	}
+	if mapping["kernel32.dll"] != "pwrp_k32.dll" {
+		t.Errorf("./progwrp.ini was read: mapping[kernel32.dll] = %q", mapping["kernel32.dll"])
+	}
+
+	// Passing it explicitly reads it without the warning
+	out = captureOutput(t, func() {
+		if _, err := loadMapping(iniFileName); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if strings.Contains(out, "warning") {
+		t.Errorf("unexpected warning %q", out)
+	}
+	if mapping["kernel32.dll"] != "custom_k32.dll" {
+		t.Errorf("mapping[kernel32.dll] = %q, want custom_k32.dll", mapping["kernel32.dll"])
+	}
+}
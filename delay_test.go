@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestRedirectDelayLoadImports(t *testing.T) {
+	tests := []struct {
+		name string
+		spec fxSpec
+	}{
+		{"x86 RVA descriptors", fxSpec{}},
+		{"x86 VA descriptors", fxSpec{DelayVA: true}},
+		{"x86_64 RVA descriptors", fxSpec{Is64: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := newTestDir(t)
+			arch := fixtureArch(tt.spec.Is64)
+			mapping["kernel32.dll"] = "pwrp_k32.dll"
+			mapping["user32.dll"] = "progwrp_user32.dll"
+			writeFixture(t, blobsBaseDir, arch+"/pwrp_k32.dll", fxSpec{Is64: tt.spec.Is64, Dll: true,
+				Name: "pwrp_k32.dll", Exports: []fxExport{{Name: "GetTickCount64"}}})
+			writeFixture(t, blobsBaseDir, arch+"/progwrp_user32.dll", fxSpec{Is64: tt.spec.Is64, Dll: true,
+				Name: "progwrp_user32.dll", Exports: []fxExport{{Name: "GetDpiForWindow"}}})
+			spec := tt.spec
+			spec.Delay = []fxImport{
+				{DLL: "kernel32.dll", Funcs: []string{"GetTickCount64"}},
+				{DLL: "user32.dll", Funcs: []string{"GetDpiForWindow"}},
+			}
+			app := writeFixture(t, dir, "app.exe", spec)
+			original := readFixture(t, app)
+
+			out := patchFixture(t, app)
+			// The user32 name does not fit and moves to .pwrp, a VA has to be stored for it
+			want := []string{"delay pwrp_k32.dll!GetTickCount64", "delay progwrp_user32.dll!GetDpiForWindow"}
+			if got := fixtureImports(t, out); !reflect.DeepEqual(got, want) {
+				t.Errorf("imports = %v, want %v", got, want)
+			}
+
+			patched := readFixture(t, out)
+			r, err := loadUndoRecord(undoRecordPath(out))
+			if err != nil {
+				t.Fatal(err)
+			}
+			restored, err := r.apply(patched)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(restored, original) {
+				t.Errorf("restored file differs from the original")
+			}
+		})
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	pefile "github.com/saferwall/pe"
+)
+
+// Make patched binaries import the _patched names of the application DLLs patched next to them
+var linkPatched bool
+
+// Files written by patchFile, by input path
+var patchedOutputs = make(map[string]string)
+
+// progwrp DLLs copied next to patched binaries, by destination path
+var deployedBlobs = make(map[string]bool)
+
+// Directory the input layout is mirrored to with -o, and the input directory it mirrors
+var outputDir, inputRoot string
+
+// With -o, also copy the input files that were not patched
+var copyUnpatched bool
+
+// Directory of the executable that loads each input file, by input path. DLLs below an
+// executable are resolved and get their progwrp DLLs there rather than in their own directory.
+var appDirs = make(map[string]string)
+
+// New names of the application DLLs in the directory of the file being patched, by lowercase
+// name. Only set while relinking with -link-patched.
+var appDllRenames map[string]string
+
+// patchedPath returns the file patchFile writes the patched copy of path to: path itself with
+// -inplace, the same name under the output directory with -o, otherwise a _patched sibling
+func patchedPath(path string) string {
+	if inPlace {
+		return path
+	}
+	if outputDir != "" {
+		return mirroredPath(path)
+	}
+	return path[:len(path)-len(filepath.Ext(path))] + "_patched" + filepath.Ext(path)
+}
+
+// setInputRoot sets the input directory that the output and backup directories mirror
+func setInputRoot(input string) error {
+	info, err := os.Stat(input)
+	if err != nil {
+		return err
+	}
+	inputRoot = input
+	if !info.IsDir() {
+		inputRoot = filepath.Dir(input)
+	}
+	return nil
+}
+
+// checkOutputTree makes sure the -o directory is not the input directory
+func checkOutputTree() error {
+	absInput, err := filepath.Abs(inputRoot)
+	if err != nil {
+		return err
+	}
+	absOutput, err := filepath.Abs(outputDir)
+	if err != nil {
+		return err
+	}
+	if absInput == absOutput {
+		return fmt.Errorf("output directory %s is the input directory, the originals would be overwritten", outputDir)
+	}
+	return nil
+}
+
+// mirroredPath returns where a file of the input goes in the output directory
+func mirroredPath(path string) string {
+	rel, err := filepath.Rel(inputRoot, path)
+	if err != nil {
+		rel = filepath.Base(path)
+	}
+	return filepath.Join(outputDir, rel)
+}
+
+// isOutputDir reports whether a directory of the input is the output or backup directory, which
+// must not be patched again when it lies inside the input
+func isOutputDir(dir string) bool {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	for _, d := range []string{outputDir, backupDir} {
+		if d == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(d); err == nil && abs == absDir {
+			return true
+		}
+	}
+	return false
+}
+
+// copyUnpatchedFiles copies the input files that were not patched to the output directory,
+// leaving the progwrp DLLs deployed there alone
+func copyUnpatchedFiles(files []string) {
+	copied := 0
+	for _, path := range files {
+		if _, ok := patchedOutputs[path]; ok {
+			continue
+		}
+		dest := mirroredPath(path)
+		if deployedBlobs[dest] {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			fmt.Printf("warning: failed to copy %s: %v\n", path, err)
+			continue
+		}
+		if err := copyFile(path, dest); err != nil {
+			fmt.Printf("warning: failed to copy %s: %v\n", path, err)
+			continue
+		}
+		copied++
+	}
+	fmt.Printf("copied %d unpatched files to %s\n", copied, outputDir)
+}
+
+// setApplicationDirs records the application directory of every input file: its own directory
+// for executables, otherwise the closest directory above it that holds an executable
+func setApplicationDirs(files []string) {
+	exeDirs := make(map[string]bool)
+	for _, path := range files {
+		if strings.EqualFold(filepath.Ext(path), ".exe") {
+			exeDirs[filepath.Dir(path)] = true
+		}
+	}
+	for _, path := range files {
+		dir := filepath.Dir(path)
+		for d := dir; ; d = filepath.Dir(d) {
+			if exeDirs[d] {
+				dir = d
+				break
+			}
+			if filepath.Dir(d) == d {
+				break
+			}
+		}
+		appDirs[path] = dir
+	}
+}
+
+// applicationDir returns the directory the loader resolves the imports of a file from
+func applicationDir(path string) string {
+	if dir, ok := appDirs[path]; ok {
+		return dir
+	}
+	return filepath.Dir(path)
+}
+
+// blobDir returns where the progwrp DLLs of a patched file are deployed: the application
+// directory, in the output tree with -o
+func blobDir(path, outPath string) string {
+	dir, ok := appDirs[path]
+	if !ok {
+		return filepath.Dir(outPath)
+	}
+	if outputDir != "" {
+		return mirroredPath(dir)
+	}
+	return dir
+}
+
+// importedDllNames returns the lowercase names of the DLLs a binary imports, delay-loaded ones included
+func importedDllNames(path string) ([]string, error) {
+	pe, err := pefile.New(path, &pefile.Options{Fast: false})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open PE file: %v", err)
+	}
+	defer pe.Close()
+	if err := pe.Parse(); err != nil {
+		return nil, fmt.Errorf("failed to parse PE file: %v", err)
+	}
+	var names []string
+	seen := make(map[string]bool)
+	for _, desc := range importDescriptors(pe) {
+		lower := strings.ToLower(desc.Name)
+		if !seen[lower] {
+			seen[lower] = true
+			names = append(names, lower)
+		}
+	}
+	return names, nil
+}
+
+// collectFiles returns the .exe and .dll files of the input and its other files, descending
+// into subdirectories with recurse but never into the output or backup directory
+func collectFiles(input string, recurse bool) (files, others []string) {
+	filepath.Walk(input, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if path != input && (!recurse || isOutputDir(path)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		if ext == ".exe" || ext == ".dll" {
+			files = append(files, path)
+		} else {
+			others = append(others, path)
+		}
+		return nil
+	})
+	return files, others
+}
+
+// patchFiles patches every file found in the input, then makes the binaries of the application
+// agree on which of its DLLs they load
+func patchFiles(files []string, repo string, debug bool) {
+	// Outputs of an earlier run would be patched again into name_patched_patched
+	inputs := make(map[string]bool)
+	for _, path := range files {
+		inputs[path] = true
+	}
+
+	setApplicationDirs(files)
+	archs := make(map[string]string)
+	var patchable []string
+	for _, path := range files {
+		// Skip progwrp replacement DLLs
+		if isProgwrpFile(path) {
+			fmt.Printf("skipping progwrp file: %s\n", path)
+			continue
+		}
+		if base := strings.TrimSuffix(path, filepath.Ext(path)); strings.HasSuffix(base, "_patched") &&
+			outputDir == "" && inputs[strings.TrimSuffix(base, "_patched")+filepath.Ext(path)] {
+			fmt.Printf("skipping earlier patcher output: %s\n", path)
+			continue
+		}
+
+		arch, err := detectArch(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "arch detect failed for %s: %v\n", path, err)
+			continue
+		}
+
+		// Ensure blobs for this arch are present
+		archDir := filepath.Join(blobsBaseDir, arch)
+		if info, err := os.Stat(archDir); err != nil || !info.IsDir() {
+			fmt.Printf("fetching %s blobs from GitHub (%s)...\n", arch, repo)
+			if err := fetchBlobs(repo, arch); err != nil {
+				fmt.Fprintf(os.Stderr, "error fetching %s blobs: %v\n", arch, err)
+				continue
+			}
+		}
+
+		if inPlace {
+			if backup := backupPath(path); fileExists(backup) {
+				fmt.Printf("skipping %s: already patched in place, its original is %s\n", path, backup)
+				continue
+			}
+		}
+
+		archs[path] = arch
+		patchable = append(patchable, path)
+		if err := patchFile(path, arch, debug); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to patch %s: %v\n", path, err)
+		}
+	}
+
+	// In place and in the output tree patched binaries keep their names, so their importers already load them
+	if !checkOnly && !inPlace && outputDir == "" {
+		linkApplication(patchable, archs, debug)
+	}
+}
+
+// linkApplication handles binaries that import DLLs of the application which were patched: the
+// loader looks for them in the application directory, where it would still find the unpatched
+// name. DLLs in subdirectories are resolved from the directory of their executable as well. With -link-patched the importing binaries are patched again with those imports
+// renamed to the _patched names, which in turn may produce patched copies of DLLs that did not
+// need progwrp themselves, so this repeats until no binary gains a new patched dependency.
+// Without it the affected imports are reported.
+func linkApplication(files []string, archs map[string]string, debug bool) {
+	// Patched DLLs by application directory, then by lowercase name. Only DLLs in the
+	// application directory itself are found by name.
+	renames := make(map[string]map[string]string)
+	addRename := func(path string) bool {
+		out, ok := patchedOutputs[path]
+		if !ok {
+			return false
+		}
+		dir := filepath.Dir(path)
+		if dir != applicationDir(path) {
+			return false
+		}
+		if renames[dir] == nil {
+			renames[dir] = make(map[string]string)
+		}
+		lower := strings.ToLower(filepath.Base(path))
+		if _, ok := renames[dir][lower]; ok {
+			return false
+		}
+		renames[dir][lower] = filepath.Base(out)
+		return true
+	}
+	for _, path := range files {
+		addRename(path)
+	}
+	if len(renames) == 0 {
+		return
+	}
+
+	imports := make(map[string][]string)
+	for _, path := range files {
+		names, err := importedDllNames(path)
+		if err != nil {
+			fmt.Printf("warning: cannot read imports of %s: %v\n", path, err)
+			continue
+		}
+		imports[path] = names
+	}
+
+	if !linkPatched {
+		for _, path := range files {
+			dir := applicationDir(path)
+			for _, dll := range imports[path] {
+				if renamed, ok := renames[dir][dll]; ok {
+					fmt.Printf("warning: %s imports %s, which was patched to %s; it will still load the unpatched DLL (see -link-patched)\n", path, dll, renamed)
+				}
+			}
+		}
+		return
+	}
+
+	// Number of patched dependencies each file was last patched with
+	linked := make(map[string]int)
+	for changed := true; changed; {
+		changed = false
+		for _, path := range files {
+			dir := applicationDir(path)
+			var deps []string
+			for _, dll := range imports[path] {
+				if _, ok := renames[dir][dll]; ok {
+					deps = append(deps, dll)
+				}
+			}
+			if len(deps) == linked[path] {
+				continue
+			}
+			linked[path] = len(deps)
+
+			sort.Strings(deps)
+			fmt.Printf("relinking %s to the patched %s\n", path, strings.Join(deps, ", "))
+			appDllRenames = renames[dir]
+			err := patchFile(path, archs[path], debug)
+			appDllRenames = nil
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to relink %s: %v\n", path, err)
+				continue
+			}
+			if addRename(path) {
+				changed = true
+			}
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestLinkApplicationResolvesFromExeDirectory(t *testing.T) {
+	dir := newTestDir(t)
+	mapping["kernel32.dll"] = "pwrp_k32.dll"
+	linkPatched = true
+	writeFixture(t, blobsBaseDir, "x86/pwrp_k32.dll", fxSpec{Dll: true, Name: "pwrp_k32.dll",
+		Exports: []fxExport{{Name: "GetTickCount64"}}})
+	appDir := filepath.Join(dir, "app")
+	app := writeFixture(t, appDir, "app.exe", fxSpec{Imports: []fxImport{
+		{DLL: "core.dll", Funcs: []string{"CoreInit"}},
+	}})
+	core := writeFixture(t, appDir, "core.dll", fxSpec{Dll: true, Name: "core.dll", Imports: []fxImport{
+		{DLL: "kernel32.dll", Funcs: []string{"GetTickCount64"}},
+	}})
+	// A plugin loads core.dll and the progwrp DLLs from the directory of app.exe, not its own
+	plugin := writeFixture(t, appDir, "plugins/plugin.dll", fxSpec{Dll: true, Name: "plugin.dll", Imports: []fxImport{
+		{DLL: "kernel32.dll", Funcs: []string{"GetTickCount64"}},
+		{DLL: "core.dll", Funcs: []string{"CoreInit"}},
+	}})
+
+	patchFiles([]string{app, core, plugin}, "", false)
+
+	for path, want := range map[string][]string{
+		app:    {"core_patched.dll!CoreInit"},
+		plugin: {"pwrp_k32.dll!GetTickCount64", "core_patched.dll!CoreInit"},
+	} {
+		if got := fixtureImports(t, patchedPath(path)); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s imports = %v, want %v", filepath.Base(path), got, want)
+		}
+	}
+	if !fileExists(filepath.Join(appDir, "pwrp_k32.dll")) {
+		t.Errorf("pwrp_k32.dll was not deployed next to app.exe")
+	}
+	if fileExists(filepath.Join(appDir, "plugins", "pwrp_k32.dll")) {
+		t.Errorf("pwrp_k32.dll was deployed next to the plugin")
+	}
+}
+
+func TestSetApplicationDirs(t *testing.T) {
+	newTestDir(t)
+	root := filepath.FromSlash("/app")
+	files := []string{
+		filepath.Join(root, "app.exe"),
+		filepath.Join(root, "core.dll"),
+		filepath.Join(root, "plugins", "a", "plugin.dll"),
+		filepath.Join(root, "tools", "tool.exe"),
+		filepath.Join(root, "tools", "tool.dll"),
+	}
+	setApplicationDirs(append(files, filepath.FromSlash("/lib/standalone.dll")))
+
+	want := map[string]string{
+		files[0]: root,
+		files[1]: root,
+		files[2]: root,
+		files[3]: filepath.Join(root, "tools"),
+		files[4]: filepath.Join(root, "tools"),
+		filepath.FromSlash("/lib/standalone.dll"): filepath.FromSlash("/lib"),
+	}
+	for path, dir := range want {
+		if got := applicationDir(path); got != dir {
+			t.Errorf("applicationDir(%s) = %s, want %s", path, got, dir)
+		}
+	}
+}
+
+// treeFiles returns the contents of every file below root, by slash-separated relative path
+func treeFiles(t *testing.T, root string) map[string][]byte {
+	t.Helper()
+	files := make(map[string][]byte)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = readFixture(t, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestOutputTreeRecursive(t *testing.T) {
+	dir := newTestDir(t)
+	mapping["kernel32.dll"] = "pwrp_k32.dll"
+	blob := writeFixture(t, blobsBaseDir, "x86/pwrp_k32.dll", fxSpec{Dll: true, Name: "pwrp_k32.dll",
+		Exports: []fxExport{{Name: "GetTickCount64"}}})
+	input := filepath.Join(dir, "in")
+	kernel32 := []fxImport{{DLL: "kernel32.dll", Funcs: []string{"GetTickCount64"}}}
+	writeFixture(t, input, "app.exe", fxSpec{Imports: kernel32})
+	writeFixture(t, input, "plugins/plugin.dll", fxSpec{Dll: true, Name: "plugin.dll", Imports: kernel32})
+	writeFixture(t, input, "tools/tool.exe", fxSpec{Imports: kernel32})
+	writeFixture(t, input, "lib/plain.dll", fxSpec{Dll: true, Name: "plain.dll", Imports: []fxImport{
+		{DLL: "user32.dll", Funcs: []string{"MessageBoxA"}},
+	}})
+	if err := os.WriteFile(filepath.Join(input, "readme.txt"), []byte("readme"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before := treeFiles(t, input)
+
+	outputDir = filepath.Join(dir, "out")
+	copyUnpatched = true
+	if err := setInputRoot(input); err != nil {
+		t.Fatal(err)
+	}
+	files, others := collectFiles(input, true)
+	patchFiles(files, "", false)
+	copyUnpatchedFiles(append(files, others...))
+
+	if after := treeFiles(t, input); !reflect.DeepEqual(after, before) {
+		t.Errorf("input tree changed")
+	}
+	out := treeFiles(t, outputDir)
+	var names []string
+	for name := range out {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	want := []string{
+		"app.exe", "app.exe.unpatch.json",
+		"lib/plain.dll",
+		"plugins/plugin.dll", "plugins/plugin.dll.unpatch.json",
+		"pwrp_k32.dll",
+		"readme.txt",
+		"tools/pwrp_k32.dll", "tools/tool.exe", "tools/tool.exe.unpatch.json",
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("output tree = %v, want %v", names, want)
+	}
+
+	for _, name := range []string{"app.exe", "plugins/plugin.dll", "tools/tool.exe"} {
+		got := fixtureImports(t, filepath.Join(outputDir, filepath.FromSlash(name)))
+		if !reflect.DeepEqual(got, []string{"pwrp_k32.dll!GetTickCount64"}) {
+			t.Errorf("%s imports = %v", name, got)
+		}
+	}
+	for _, name := range []string{"lib/plain.dll", "readme.txt"} {
+		if !bytes.Equal(out[name], before[name]) {
+			t.Errorf("%s was not copied unchanged", name)
+		}
+	}
+	for _, name := range []string{"pwrp_k32.dll", "tools/pwrp_k32.dll"} {
+		if !bytes.Equal(out[name], readFixture(t, blob)) {
+			t.Errorf("%s is not the blob", name)
+		}
+	}
+}
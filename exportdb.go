@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// exportDatabase is an offline copy of the export tables of a Windows installation
+type exportDatabase struct {
+	Source  string                    `json:"source"`
+	Arch    string                    `json:"arch"`
+	Modules map[string]*moduleExports `json:"modules"` // keyed by lowercase DLL name
+}
+
+// lookup returns the exports of a DLL by name, ignoring case
+func (db *exportDatabase) lookup(name string) *moduleExports {
+	return db.Modules[strings.ToLower(name)]
+}
+
+// isGobPath reports whether a database path selects the gob encoding instead of JSON
+func isGobPath(path string) bool {
+	return strings.ToLower(filepath.Ext(path)) == ".gob"
+}
+
+// loadExportDatabase reads a database written by the exportdb command
+func loadExportDatabase(path string) (*exportDatabase, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open export database: %v", err)
+	}
+	defer file.Close()
+
+	db := &exportDatabase{}
+	if isGobPath(path) {
+		err = gob.NewDecoder(file).Decode(db)
+	} else {
+		err = json.NewDecoder(file).Decode(db)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode export database: %v", err)
+	}
+
+	// The lookup indexes are not serialized
+	for name, mod := range db.Modules {
+		db.Modules[name] = newModuleExports(mod.Name, mod.Exports)
+	}
+	return db, nil
+}
+
+// writeExportDatabase stores a database as JSON, or gob when the path ends in .gob
+func writeExportDatabase(path string, db *exportDatabase) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create export database: %v", err)
+	}
+	defer file.Close()
+
+	if isGobPath(path) {
+		err = gob.NewEncoder(file).Encode(db)
+	} else {
+		err = json.NewEncoder(file).Encode(db)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write export database: %v", err)
+	}
+	return nil
+}
+
+// captureExports collects the exports of every DLL in a directory
+func captureExports(dir string, recurse, debug bool) (*exportDatabase, error) {
+	db := &exportDatabase{Modules: make(map[string]*moduleExports)}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != dir && !recurse {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.ToLower(filepath.Ext(path)) != ".dll" {
+			return nil
+		}
+
+		arch, err := detectArch(path)
+		if err != nil {
+			fmt.Printf("warning: skipping %s: %v\n", path, err)
+			return nil
+		}
+		if db.Arch == "" {
+			db.Arch = arch
+		} else if arch != db.Arch {
+			fmt.Printf("warning: skipping %s: %s DLL in a %s database\n", path, arch, db.Arch)
+			return nil
+		}
+
+		lower := strings.ToLower(info.Name())
+		if _, ok := db.Modules[lower]; ok {
+			fmt.Printf("warning: skipping duplicate %s\n", path)
+			return nil
+		}
+		mod, err := readModuleExports(path)
+		if err != nil {
+			fmt.Printf("warning: skipping %s: %v\n", path, err)
+			return nil
+		}
+		// Keep the database stable between runs
+		sort.Slice(mod.Exports, func(i, j int) bool {
+			return mod.Exports[i].Ordinal < mod.Exports[j].Ordinal
+		})
+		db.Modules[lower] = mod
+		if debug {
+			fmt.Printf("[DEBUG] %s: %d exports\n", info.Name(), len(mod.Exports))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(db.Modules) == 0 {
+		return nil, fmt.Errorf("no DLLs found in %s", dir)
+	}
+	return db, nil
+}
+
+// runExportDB implements the exportdb command
+func runExportDB(args []string) error {
+	fs := flag.NewFlagSet("exportdb", flag.ExitOnError)
+	input := fs.String("i", "", "directory holding the system DLLs of the target installation")
+	output := fs.String("o", "exports.json", "database to write (.json or .gob)")
+	source := fs.String("source", "", "description of the installation, e.g. \"Windows XP SP3\"")
+	recurse := fs.Bool("r", false, "recurse into directories")
+	debug := fs.Bool("debug", false, "enable debug output")
+	fs.Parse(args)
+
+	if *input == "" {
+		return fmt.Errorf("exportdb requires -i")
+	}
+	db, err := captureExports(*input, *recurse, *debug)
+	if err != nil {
+		return err
+	}
+	db.Source = *source
+	if err := writeExportDatabase(*output, db); err != nil {
+		return err
+	}
+	fmt.Printf("wrote exports of %d %s DLLs to %s\n", len(db.Modules), db.Arch, *output)
+	return nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	pefile "github.com/saferwall/pe"
+)
+
+// Maximum number of forwarder hops followed before giving up on an export
+const maxForwarderDepth = 16
+
+// exportEntry is a single exported function of a DLL
+type exportEntry struct {
+	Name      string `json:"name,omitempty"`
+	Ordinal   uint32 `json:"ordinal"`
+	Forwarder string `json:"forwarder,omitempty"`
+}
+
+// moduleExports holds the export table of a DLL indexed by name and ordinal
+type moduleExports struct {
+	Name    string        `json:"name"`
+	Exports []exportEntry `json:"exports"`
+
+	byName    map[string]*exportEntry
+	byOrdinal map[uint32]*exportEntry
+}
+
+// missingImport describes an imported function that the progwrp blobs do not provide
+type missingImport struct {
+	DLL         string // DLL named by the import descriptor
+	Replacement string // progwrp DLL the descriptor is redirected to
+	Function    string // function name, or #ordinal
+	Delay       bool   // imported through the delay-load directory
+	Export      string // set for export forwarders, the export forwarding to the function
+	Reason      string
+}
+
+// Export tables of the blobs for each architecture, keyed by lowercase DLL name
+var blobExports = make(map[string]map[string]*moduleExports)
+
+// newModuleExports builds the lookup indexes for a list of exports
+func newModuleExports(name string, exports []exportEntry) *moduleExports {
+	m := &moduleExports{
+		Name:      name,
+		Exports:   exports,
+		byName:    make(map[string]*exportEntry),
+		byOrdinal: make(map[uint32]*exportEntry),
+	}
+	for i := range m.Exports {
+		e := &m.Exports[i]
+		if e.Name != "" {
+			m.byName[e.Name] = e
+		}
+		m.byOrdinal[e.Ordinal] = e
+	}
+	return m
+}
+
+// lookup finds an export by name, or by ordinal when the name has the form #N
+func (m *moduleExports) lookup(function string) *exportEntry {
+	if strings.HasPrefix(function, "#") {
+		ordinal, err := strconv.ParseUint(function[1:], 10, 32)
+		if err != nil {
+			return nil
+		}
+		return m.byOrdinal[uint32(ordinal)]
+	}
+	return m.byName[function]
+}
+
+// parsePE opens and parses a PE file with saferwall/pe, the caller must Close it
+func parsePE(path string) (*pefile.File, error) {
+	pe, err := pefile.New(path, &pefile.Options{Fast: false})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open PE file: %v", err)
+	}
+	if err := pe.Parse(); err != nil {
+		pe.Close()
+		return nil, fmt.Errorf("failed to parse PE file: %v", err)
+	}
+	return pe, nil
+}
+
+// exportsOf collects the export table of a parsed PE file
+func exportsOf(pe *pefile.File, name string) *moduleExports {
+	exports := make([]exportEntry, 0, len(pe.Export.Functions))
+	for _, fn := range pe.Export.Functions {
+		exports = append(exports, exportEntry{
+			Name:      fn.Name,
+			Ordinal:   fn.Ordinal,
+			Forwarder: fn.Forwarder,
+		})
+	}
+	return newModuleExports(name, exports)
+}
+
+// readModuleExports parses the export directory of a PE file
+func readModuleExports(path string) (*moduleExports, error) {
+	pe, err := parsePE(path)
+	if err != nil {
+		return nil, err
+	}
+	defer pe.Close()
+	return exportsOf(pe, filepath.Base(path)), nil
+}
+
+// splitForwarder splits a forwarder string such as "NTDLL.RtlAllocateHeap"
+// into the target DLL file name and the function (or #ordinal) it names
+func splitForwarder(forwarder string) (string, string, bool) {
+	dot := strings.Index(forwarder, ".")
+	if dot <= 0 || dot == len(forwarder)-1 {
+		return "", "", false
+	}
+	module := strings.ToLower(forwarder[:dot])
+	if filepath.Ext(module) == "" {
+		module += ".dll"
+	}
+	return module, forwarder[dot+1:], true
+}
+
+// importFunctionName returns the name used for an imported function, #N for ordinal imports
+func importFunctionName(fn pefile.ImportFunction) string {
+	if fn.ByOrdinal {
+		return fmt.Sprintf("#%d", fn.Ordinal)
+	}
+	return fn.Name
+}
+
+// loadBlobExports parses the export tables of every blob for an architecture
+func loadBlobExports(arch string) (map[string]*moduleExports, error) {
+	if exports, ok := blobExports[arch]; ok {
+		return exports, nil
+	}
+
+	archDir := filepath.Join(blobsBaseDir, arch)
+	entries, err := os.ReadDir(archDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blobs directory: %v", err)
+	}
+
+	exports := make(map[string]*moduleExports)
+	for _, entry := range entries {
+		if entry.IsDir() || strings.ToLower(filepath.Ext(entry.Name())) != ".dll" {
+			continue
+		}
+		mod, err := readModuleExports(filepath.Join(archDir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read exports of %s: %v", entry.Name(), err)
+		}
+		exports[strings.ToLower(entry.Name())] = mod
+	}
+	blobExports[arch] = exports
+	return exports, nil
+}
+
+// resolveBlobExport checks that a blob exports a function, following forwarders between blobs.
+// Forwarders that leave the blob set point at system DLLs and are assumed to resolve.
+func resolveBlobExport(blobs map[string]*moduleExports, dll, function string, depth int) string {
+	if depth > maxForwarderDepth {
+		return "forwarder chain too deep"
+	}
+	mod, ok := blobs[strings.ToLower(dll)]
+	if !ok {
+		return fmt.Sprintf("%s is not present in the blobs", dll)
+	}
+	entry := mod.lookup(function)
+	if entry == nil {
+		return fmt.Sprintf("not exported by %s", mod.Name)
+	}
+	if entry.Forwarder == "" {
+		return ""
+	}
+	target, targetFunction, ok := splitForwarder(entry.Forwarder)
+	if !ok {
+		return fmt.Sprintf("malformed forwarder %q in %s", entry.Forwarder, mod.Name)
+	}
+	if _, isBlob := blobs[target]; !isBlob {
+		return ""
+	}
+	if reason := resolveBlobExport(blobs, target, targetFunction, depth+1); reason != "" {
+		return fmt.Sprintf("forwarded to %s: %s", entry.Forwarder, reason)
+	}
+	return ""
+}
+
+// checkCoverage lists the imported functions of a PE that would not be found
+// in the progwrp blobs once their DLLs are redirected through the mapping
+func checkCoverage(pe *pefile.File, arch string) ([]missingImport, error) {
+	blobs, err := loadBlobExports(arch)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []missingImport
+	descs := importDescriptors(pe)
+	needed := neededRedirects(descs)
+	for _, desc := range descs {
+		replacement, ok := replacementFor(desc.Name)
+		if !ok || (minimalRedirect && !needed[strings.ToLower(desc.Name)]) {
+			continue
+		}
+		for _, fn := range desc.Functions {
+			if !redirectFunction(desc.Name, importFunctionName(fn)) {
+				continue
+			}
+			function := redirectedFunctionName(desc.Name, fn)
+			if reason := resolveBlobExport(blobs, replacement, function, 0); reason != "" {
+				missing = append(missing, missingImport{
+					DLL:         desc.Name,
+					Replacement: replacement,
+					Function:    function,
+					Delay:       desc.Delay,
+					Reason:      reason,
+				})
+			}
+		}
+	}
+
+	// Forwarders are rewritten along with the imports and have to resolve in progwrp too
+	for _, fn := range pe.Export.Functions {
+		if fn.Forwarder == "" {
+			continue
+		}
+		forwarder, replacement, err := forwarderReplacement(fn.Forwarder)
+		if err == nil && forwarder == "" {
+			continue
+		}
+		dll, function, _ := splitForwarder(fn.Forwarder)
+		var reason string
+		if err != nil {
+			// patchFile refuses binaries with forwarders it cannot point at progwrp
+			replacement, _ = replacementFor(dll)
+			reason = err.Error()
+		} else {
+			_, function, _ = splitForwarder(forwarder)
+			reason = resolveBlobExport(blobs, replacement, function, 0)
+		}
+		if reason != "" {
+			export := fn.Name
+			if export == "" {
+				export = fmt.Sprintf("#%d", fn.Ordinal)
+			}
+			missing = append(missing, missingImport{
+				DLL:         dll,
+				Replacement: replacement,
+				Function:    function,
+				Export:      export,
+				Reason:      reason,
+			})
+		}
+	}
+	return missing, nil
+}
+
+// reportCoverage prints the result of checkCoverage
+func reportCoverage(path string, missing []missingImport) {
+	if len(missing) == 0 {
+		fmt.Printf("coverage: all redirected imports of %s are exported by progwrp\n", path)
+		return
+	}
+	fmt.Printf("coverage: %d redirected imports of %s are not exported by progwrp:\n", len(missing), path)
+	for _, m := range missing {
+		if m.Export != "" {
+			fmt.Printf("  %s!%s -> %s (forwarded export %s): %s\n", m.DLL, m.Function, m.Replacement, m.Export, m.Reason)
+		} else if m.Delay {
+			fmt.Printf("  %s!%s -> %s (delay-load): %s\n", m.DLL, m.Function, m.Replacement, m.Reason)
+		} else {
+			fmt.Printf("  %s!%s -> %s: %s\n", m.DLL, m.Function, m.Replacement, m.Reason)
+		}
+	}
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fxImport is an import descriptor of a fixture, functions named "#N" are imported by ordinal
+type fxImport struct {
+	DLL   string
+	Funcs []string
+}
+
+// fxExport is an export of a fixture DLL, ordinals default to the position in the list
+type fxExport struct {
+	Name      string
+	Ordinal   uint32
+	Forwarder string
+}
+
+// fxSpec describes a synthetic PE image
+type fxSpec struct {
+	Is64       bool
+	Dll        bool
+	Name       string
+	Imports    []fxImport
+	Delay      []fxImport
+	DelayVA    bool // delay-load descriptors hold VAs (Attributes 0), as linkers before VC7 wrote them
+	Exports    []fxExport
+	Overlay    []byte
+	BoundTo    []string // bound import directory in the header slack naming these DLLs
+	HeaderSize uint32
+	LoadCfg    bool
+	DllChars   uint16
+	Checksum   uint32
+	SharedName bool   // descriptors of the same DLL share one name string
+	Signature  []byte // WIN_CERTIFICATE contents placed after the overlay
+}
+
+// fxBuf is the contents of a fixture section being laid out
+type fxBuf struct {
+	base uint32
+	b    []byte
+}
+
+func (f *fxBuf) rva() uint32 { return f.base + uint32(len(f.b)) }
+
+func (f *fxBuf) align(n int) {
+	for len(f.b)%n != 0 {
+		f.b = append(f.b, 0)
+	}
+}
+
+func (f *fxBuf) str(s string) uint32 {
+	r := f.rva()
+	f.b = append(f.b, []byte(s)...)
+	f.b = append(f.b, 0)
+	return r
+}
+
+func (f *fxBuf) u16(v uint16) { f.b = append(f.b, byte(v), byte(v>>8)) }
+
+func (f *fxBuf) u32(v uint32) {
+	var t [4]byte
+	binary.LittleEndian.PutUint32(t[:], v)
+	f.b = append(f.b, t[:]...)
+}
+
+func (f *fxBuf) u64(v uint64) {
+	var t [8]byte
+	binary.LittleEndian.PutUint64(t[:], v)
+	f.b = append(f.b, t[:]...)
+}
+
+// buildPE lays out a small PE32 or PE32+ image with .text, .rdata (import, export and load
+// config data) and .data (import address tables) sections
+func buildPE(s fxSpec) []byte {
+	const fileAlign, sectAlign = 0x200, 0x1000
+	hdrSize := s.HeaderSize
+	if hdrSize == 0 {
+		hdrSize = 0x400
+	}
+	textRVA := uint32(0x1000)
+	rdataRVA := uint32(0x2000)
+	dataRVA := uint32(0x3000)
+	thunk := 4
+	if s.Is64 {
+		thunk = 8
+	}
+	var dirs [16][2]uint32
+
+	rd := &fxBuf{base: rdataRVA}
+	dd := &fxBuf{base: dataRVA}
+	type built struct{ lookup, iat, name uint32 }
+	putThunks := func(buf *fxBuf, vals []uint64) uint32 {
+		buf.align(thunk)
+		r := buf.rva()
+		for _, v := range append(vals, 0) {
+			if s.Is64 {
+				buf.u64(v)
+			} else {
+				buf.u32(uint32(v))
+			}
+		}
+		return r
+	}
+	ordFlag := uint64(0x80000000)
+	if s.Is64 {
+		ordFlag = 1 << 63
+	}
+	thunkVals := func(funcs []string) []uint64 {
+		var vals []uint64
+		for _, fn := range funcs {
+			if strings.HasPrefix(fn, "#") {
+				n, _ := strconv.Atoi(fn[1:])
+				vals = append(vals, ordFlag|uint64(n))
+				continue
+			}
+			rd.align(2)
+			r := rd.rva()
+			rd.u16(0)
+			rd.str(fn)
+			vals = append(vals, uint64(r))
+		}
+		return vals
+	}
+
+	var imps []built
+	names := map[string]uint32{}
+	for _, im := range s.Imports {
+		vals := thunkVals(im.Funcs)
+		lookup := putThunks(rd, vals)
+		iat := putThunks(dd, vals)
+		n, ok := names[strings.ToLower(im.DLL)]
+		if !ok || !s.SharedName {
+			n = rd.str(im.DLL)
+			names[strings.ToLower(im.DLL)] = n
+		}
+		imps = append(imps, built{lookup, iat, n})
+	}
+	if len(imps) > 0 {
+		rd.align(4)
+		dirs[dirImport][0] = rd.rva()
+		for _, b := range imps {
+			rd.u32(b.lookup)
+			rd.u32(0)
+			rd.u32(0)
+			rd.u32(b.name)
+			rd.u32(b.iat)
+		}
+		rd.b = append(rd.b, make([]byte, 20)...)
+		dirs[dirImport][1] = uint32(20 * (len(imps) + 1))
+	}
+
+	var dimps []built
+	var hmods []uint32
+	var va uint32 // added to every pointer of old style delay-load data
+	if s.DelayVA {
+		va = 0x400000
+	}
+	for _, im := range s.Delay {
+		vals := thunkVals(im.Funcs)
+		for i := range vals {
+			if vals[i]&ordFlag == 0 {
+				vals[i] += uint64(va)
+			}
+		}
+		lookup := putThunks(rd, vals)
+		iat := putThunks(dd, vals)
+		n := rd.str(im.DLL)
+		dd.align(8)
+		hmods = append(hmods, dd.rva())
+		dd.u64(0)
+		dimps = append(dimps, built{lookup, iat, n})
+	}
+	if len(dimps) > 0 {
+		rd.align(4)
+		dirs[dirDelayImport][0] = rd.rva()
+		for i, b := range dimps {
+			if s.DelayVA {
+				rd.u32(0)
+			} else {
+				rd.u32(1) // RVA based
+			}
+			rd.u32(b.name + va)
+			rd.u32(hmods[i] + va)
+			rd.u32(b.iat + va)
+			rd.u32(b.lookup + va)
+			rd.u32(0)
+			rd.u32(0)
+			rd.u32(0)
+		}
+		rd.b = append(rd.b, make([]byte, 32)...)
+		dirs[dirDelayImport][1] = uint32(32 * (len(dimps) + 1))
+	}
+
+	if len(s.Exports) > 0 {
+		rd.align(4)
+		dirRVA := rd.rva()
+		rd.b = append(rd.b, make([]byte, 40)...)
+		nameRVA := rd.str(s.Name)
+		base := uint32(1)
+		maxOrd := uint32(0)
+		ords := make([]uint32, len(s.Exports))
+		for i, e := range s.Exports {
+			o := e.Ordinal
+			if o == 0 {
+				o = uint32(i + 1)
+			}
+			ords[i] = o
+			if o > maxOrd {
+				maxOrd = o
+			}
+		}
+		funcRVAs := make([]uint32, maxOrd-base+1)
+		type named struct {
+			name string
+			idx  uint16
+		}
+		var sorted []named
+		for i, e := range s.Exports {
+			if e.Forwarder != "" {
+				funcRVAs[ords[i]-base] = rd.str(e.Forwarder)
+			} else {
+				funcRVAs[ords[i]-base] = textRVA
+			}
+			if e.Name != "" {
+				sorted = append(sorted, named{e.Name, uint16(ords[i] - base)})
+			}
+		}
+		for i := range sorted {
+			for j := i + 1; j < len(sorted); j++ {
+				if sorted[j].name < sorted[i].name {
+					sorted[i], sorted[j] = sorted[j], sorted[i]
+				}
+			}
+		}
+		nameRVAs := make([]uint32, len(sorted))
+		for i, n := range sorted {
+			nameRVAs[i] = rd.str(n.name)
+		}
+		rd.align(4)
+		functions := rd.rva()
+		for _, f := range funcRVAs {
+			rd.u32(f)
+		}
+		nameTable := rd.rva()
+		for _, n := range nameRVAs {
+			rd.u32(n)
+		}
+		ordinalTable := rd.rva()
+		for _, n := range sorted {
+			rd.u16(n.idx)
+		}
+		d := rd.b[dirRVA-rd.base:]
+		binary.LittleEndian.PutUint32(d[12:], nameRVA)
+		binary.LittleEndian.PutUint32(d[16:], base)
+		binary.LittleEndian.PutUint32(d[20:], uint32(len(funcRVAs)))
+		binary.LittleEndian.PutUint32(d[24:], uint32(len(sorted)))
+		binary.LittleEndian.PutUint32(d[28:], functions)
+		binary.LittleEndian.PutUint32(d[32:], nameTable)
+		binary.LittleEndian.PutUint32(d[36:], ordinalTable)
+		dirs[dirExport][0] = dirRVA
+		dirs[dirExport][1] = rd.rva() - dirRVA
+	}
+
+	if s.LoadCfg {
+		rd.align(8)
+		dirs[10][0] = rd.rva()
+		size := uint32(0x94)
+		if s.Is64 {
+			size = 0x100
+		}
+		rd.u32(size)
+		rd.b = append(rd.b, make([]byte, size-4)...)
+		dirs[10][1] = size
+	}
+	if len(dd.b) == 0 {
+		dd.u32(0)
+	}
+	dirs[dirIAT][0] = dataRVA
+	dirs[dirIAT][1] = uint32(len(dd.b))
+
+	secs := []struct {
+		name  string
+		rva   uint32
+		data  []byte
+		chars uint32
+	}{
+		{".text", textRVA, []byte{0xC3}, 0x60000020},
+		{".rdata", rdataRVA, rd.b, 0x40000040},
+		{".data", dataRVA, dd.b, 0xC0000040},
+	}
+	lfanew := uint32(0x80)
+	optSize := uint32(0xE0)
+	machine := uint16(0x14c)
+	chars := uint16(0x0102)
+	if s.Is64 {
+		optSize = 0xF0
+		machine = 0x8664
+		chars = 0x0022
+	}
+	if s.Dll {
+		chars |= 0x2000
+	}
+
+	out := make([]byte, hdrSize)
+	copy(out, "MZ")
+	binary.LittleEndian.PutUint32(out[0x3C:], lfanew)
+	copy(out[lfanew:], "PE\x00\x00")
+	coff := lfanew + 4
+	binary.LittleEndian.PutUint16(out[coff:], machine)
+	binary.LittleEndian.PutUint16(out[coff+2:], uint16(len(secs)))
+	binary.LittleEndian.PutUint16(out[coff+16:], uint16(optSize))
+	binary.LittleEndian.PutUint16(out[coff+18:], chars)
+
+	opt := coff + 20
+	last := secs[len(secs)-1]
+	sizeOfImage := alignUp(last.rva+uint32(len(last.data)), sectAlign)
+	if s.Is64 {
+		binary.LittleEndian.PutUint16(out[opt:], 0x20b)
+		binary.LittleEndian.PutUint32(out[opt+16:], textRVA)
+		binary.LittleEndian.PutUint64(out[opt+24:], 0x140000000)
+	} else {
+		binary.LittleEndian.PutUint16(out[opt:], 0x10b)
+		binary.LittleEndian.PutUint32(out[opt+16:], textRVA)
+		binary.LittleEndian.PutUint32(out[opt+28:], 0x400000)
+	}
+	binary.LittleEndian.PutUint32(out[opt+32:], sectAlign)
+	binary.LittleEndian.PutUint32(out[opt+36:], fileAlign)
+	binary.LittleEndian.PutUint16(out[opt+40:], 6)
+	binary.LittleEndian.PutUint16(out[opt+42:], 1)
+	binary.LittleEndian.PutUint16(out[opt+48:], 6)
+	binary.LittleEndian.PutUint16(out[opt+50:], 1)
+	binary.LittleEndian.PutUint32(out[opt+56:], sizeOfImage)
+	binary.LittleEndian.PutUint32(out[opt+60:], hdrSize)
+	binary.LittleEndian.PutUint32(out[opt+64:], s.Checksum)
+	binary.LittleEndian.PutUint16(out[opt+68:], 3)
+	binary.LittleEndian.PutUint16(out[opt+70:], s.DllChars)
+	dataDirectory := opt + 96
+	if s.Is64 {
+		binary.LittleEndian.PutUint64(out[opt+72:], 0x100000)
+		binary.LittleEndian.PutUint64(out[opt+80:], 0x1000)
+		binary.LittleEndian.PutUint64(out[opt+88:], 0x100000)
+		binary.LittleEndian.PutUint64(out[opt+96:], 0x1000)
+		binary.LittleEndian.PutUint32(out[opt+108:], 16)
+		dataDirectory = opt + 112
+	} else {
+		binary.LittleEndian.PutUint32(out[opt+72:], 0x100000)
+		binary.LittleEndian.PutUint32(out[opt+76:], 0x1000)
+		binary.LittleEndian.PutUint32(out[opt+80:], 0x100000)
+		binary.LittleEndian.PutUint32(out[opt+84:], 0x1000)
+		binary.LittleEndian.PutUint32(out[opt+92:], 16)
+	}
+
+	sectionTable := opt + optSize
+	fileOff := hdrSize
+	var body []byte
+	for i, sec := range secs {
+		h := sectionTable + uint32(i*40)
+		raw := alignUp(uint32(len(sec.data)), fileAlign)
+		copy(out[h:], sec.name)
+		binary.LittleEndian.PutUint32(out[h+8:], uint32(len(sec.data)))
+		binary.LittleEndian.PutUint32(out[h+12:], sec.rva)
+		binary.LittleEndian.PutUint32(out[h+16:], raw)
+		binary.LittleEndian.PutUint32(out[h+20:], fileOff)
+		binary.LittleEndian.PutUint32(out[h+36:], sec.chars)
+		d := make([]byte, raw)
+		copy(d, sec.data)
+		body = append(body, d...)
+		fileOff += raw
+	}
+
+	if len(s.BoundTo) > 0 {
+		// Leave room for one more section header before the bound import directory
+		b := sectionTable + uint32(len(secs)*40) + 40
+		dirs[dirBoundImport][0] = b
+		strOff := uint32(len(s.BoundTo)+1) * 8
+		for i, name := range s.BoundTo {
+			binary.LittleEndian.PutUint32(out[b+uint32(i*8):], 0x12345678)
+			binary.LittleEndian.PutUint16(out[b+uint32(i*8)+4:], uint16(strOff))
+			copy(out[b+strOff:], name)
+			strOff += uint32(len(name)) + 1
+		}
+		dirs[dirBoundImport][1] = strOff
+	}
+	var certificate []byte
+	if len(s.Signature) > 0 {
+		// WIN_CERTIFICATE with revision 2.0 and type PKCS_SIGNED_DATA, padded to 8 bytes
+		var h [8]byte
+		binary.LittleEndian.PutUint32(h[0:], uint32(8+len(s.Signature)))
+		binary.LittleEndian.PutUint16(h[4:], 0x200)
+		binary.LittleEndian.PutUint16(h[6:], 2)
+		certificate = append(h[:], s.Signature...)
+		for len(certificate)%8 != 0 {
+			certificate = append(certificate, 0)
+		}
+		dirs[dirSecurity][0] = hdrSize + uint32(len(body)+len(s.Overlay))
+		dirs[dirSecurity][1] = uint32(len(certificate))
+	}
+	for i := range dirs {
+		binary.LittleEndian.PutUint32(out[dataDirectory+uint32(i*8):], dirs[i][0])
+		binary.LittleEndian.PutUint32(out[dataDirectory+uint32(i*8)+4:], dirs[i][1])
+	}
+	out = append(out, body...)
+	out = append(out, s.Overlay...)
+	return append(out, certificate...)
+}
+
+// writeFixture builds a fixture and writes it to dir/name
+func writeFixture(t *testing.T, dir, name string, s fxSpec) string {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, buildPE(s), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// newTestDir resets the settings earlier tests may have changed and returns a directory whose
+// blobs subdirectory is used for the progwrp DLLs
+func newTestDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	blobsBaseDir = filepath.Join(dir, "blobs")
+	blobExports = make(map[string]map[string]*moduleExports)
+	resetMapping()
+	mappingHash = ""
+	checkOnly, minimalRedirect, splitImports = false, false, false
+	linkPatched, inPlace, zeroChecksum, copyUnpatched = false, false, false, false
+	targetName, signedPolicy = "", "strip"
+	targetVersion, targetArch, targetProfileName = osVersion{5, 1}, "", ""
+	targetExports = nil
+	disabledFixups = make(map[string]bool)
+	outputDir, backupDir, inputRoot = "", "", ""
+	journal, appDllRenames = nil, nil
+	appDirs = make(map[string]string)
+	patchedOutputs = make(map[string]string)
+	deployedBlobs = make(map[string]bool)
+	return dir
+}
+
+// fixtureImports returns the imports of a binary as "dll!function", with delay-load
+// imports prefixed by "delay "
+func fixtureImports(t *testing.T, path string) []string {
+	t.Helper()
+	pe, err := parsePE(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pe.Close()
+	var imports []string
+	for _, desc := range importDescriptors(pe) {
+		prefix := ""
+		if desc.Delay {
+			prefix = "delay "
+		}
+		for _, fn := range desc.Functions {
+			imports = append(imports, prefix+desc.Name+"!"+importFunctionName(fn))
+		}
+	}
+	return imports
+}
+
+// readFixture reads a file written by a test
+func readFixture(t *testing.T, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// patchFixture patches a fixture with the current settings and returns the patched file
+func patchFixture(t *testing.T, path string) string {
+	t.Helper()
+	arch, err := detectArch(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := patchFile(path, arch, false); err != nil {
+		t.Fatal(err)
+	}
+	return patchedPath(path)
+}
+
+// fixtureArch returns the blobs directory name of a fixture architecture
+func fixtureArch(is64 bool) string {
+	if is64 {
+		return "x86_64"
+	}
+	return "x86"
+}
+
+// sectionNames lists the section names of an image
+func sectionNames(t *testing.T, data []byte) []string {
+	t.Helper()
+	l, err := parseLayout(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for i := 0; i < l.numSections; i++ {
+		names = append(names, strings.TrimRight(string(data[l.sectionTable+uint32(i)*40:][:8]), "\x00"))
+	}
+	return names
+}
+
+// captureOutput returns what f prints to stdout
+func captureOutput(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	done := make(chan []byte)
+	go func() {
+		out, _ := io.ReadAll(r)
+		done <- out
+	}()
+	defer func() { os.Stdout = stdout }()
+	f()
+	w.Close()
+	return string(<-done)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// More data directory indexes used by the fixups
+const (
+	dirTLS        = 9
+	dirLoadConfig = 10
+)
+
+// DllCharacteristics flags older loaders do not know
+const (
+	dllCharHighEntropyVA = 0x0020
+	dllCharGuardCF       = 0x4000
+)
+
+// Size of IMAGE_LOAD_CONFIG_DIRECTORY as the XP and Server 2003 loaders know it
+const (
+	xpLoadConfigSize32 = 0x40
+	xpLoadConfigSize64 = 0x70
+)
+
+// Offsets of SEHandlerTable and SEHandlerCount in the 32-bit load config, just past what XP accepts
+const (
+	loadConfigSEHandlerTable = 0x40
+	loadConfigSEHandlerCount = 0x44
+)
+
+// fixup is one normalization of a PE feature the target loader rejects or misreads
+type fixup struct {
+	Name        string
+	Description string
+	apply       func(data []byte, l *peLayout, target targetProfile) (string, error)
+}
+
+var fixups = []fixup{
+	{"loadconfig", "shrink the load config directory to the size the XP loader accepts", fixLoadConfig},
+	{"cfg", "clear the Control Flow Guard flag", fixDllCharacteristics(dllCharGuardCF, "GUARD_CF")},
+	{"highentropyva", "clear the high entropy VA flag", fixDllCharacteristics(dllCharHighEntropyVA, "HIGH_ENTROPY_VA")},
+	{"tls", "warn about DLLs using implicit TLS, which XP does not set up for LoadLibrary", checkTLS},
+}
+
+// Fixups turned off with -no-fixup
+var disabledFixups = make(map[string]bool)
+
+// parseFixupList reads the -no-fixup list, rejecting unknown names
+func parseFixupList(list string) error {
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, f := range fixups {
+			known = known || f.Name == name
+		}
+		if !known {
+			var names []string
+			for _, f := range fixups {
+				names = append(names, f.Name)
+			}
+			return fmt.Errorf("unknown fixup %q (available: %s)", name, strings.Join(names, ", "))
+		}
+		disabledFixups[name] = true
+	}
+	return nil
+}
+
+// fixLoadConfig truncates the load config data directory. The XP and Server 2003 loaders refuse
+// images whose directory is larger than the structure they know; the fields past it (CFG and
+// so on) mean nothing to them anyway.
+func fixLoadConfig(data []byte, l *peLayout, target targetProfile) (string, error) {
+	if !target.Version.before(vista) {
+		return "", nil
+	}
+	rva, size := l.directory(data, dirLoadConfig)
+	limit := uint32(xpLoadConfigSize32)
+	if l.magic == 0x20b {
+		limit = xpLoadConfigSize64
+	}
+	if size <= limit {
+		return "", nil
+	}
+	if err := l.setDirectory(data, dirLoadConfig, rva, limit); err != nil {
+		return "", err
+	}
+	change := fmt.Sprintf("load config directory size 0x%x -> 0x%x", size, limit)
+
+	// Without its SafeSEH table the image is treated as having none, so any handler is accepted
+	if l.magic != 0x20b && size >= loadConfigSEHandlerCount+4 {
+		if offset, err := rvaToOffset(data, rva); err == nil && int(offset+loadConfigSEHandlerCount+4) <= len(data) {
+			table := binary.LittleEndian.Uint32(data[offset+loadConfigSEHandlerTable:])
+			count := binary.LittleEndian.Uint32(data[offset+loadConfigSEHandlerCount:])
+			if table != 0 || count != 0 {
+				change += fmt.Sprintf(", dropping the SafeSEH table of %d handlers (exception handlers are no longer validated)", count)
+			}
+		}
+	}
+	return change, nil
+}
+
+// fixDllCharacteristics clears a DllCharacteristics flag introduced after the target
+func fixDllCharacteristics(flag uint16, name string) func([]byte, *peLayout, targetProfile) (string, error) {
+	return func(data []byte, l *peLayout, target targetProfile) (string, error) {
+		if !target.Version.before(win8) {
+			return "", nil
+		}
+		offset := l.field(70)
+		old := binary.LittleEndian.Uint16(data[offset:])
+		if old&flag == 0 {
+			return "", nil
+		}
+		binary.LittleEndian.PutUint16(data[offset:], old&^flag)
+		return fmt.Sprintf("DllCharacteristics 0x%04x -> 0x%04x (cleared %s)", old, old&^flag, name), nil
+	}
+}
+
+// checkTLS reports DLLs with implicit TLS data. Before Vista the loader only allocates TLS for
+// modules loaded at process start, so such a DLL crashes when loaded with LoadLibrary. There is
+// nothing to rewrite, the warning tells where to look.
+func checkTLS(data []byte, l *peLayout, target targetProfile) (string, error) {
+	if !target.Version.before(vista) {
+		return "", nil
+	}
+	characteristics := binary.LittleEndian.Uint16(data[l.fileHeader+18:])
+	rva, size := l.directory(data, dirTLS)
+	if characteristics&0x2000 == 0 || size == 0 {
+		return "", nil
+	}
+	offset, err := rvaToOffset(data, rva)
+	if err != nil {
+		return "", fmt.Errorf("TLS directory: %v", err)
+	}
+	if int(offset)+40 > len(data) {
+		return "", fmt.Errorf("TLS directory at 0x%x is truncated", offset)
+	}
+	// StartAddressOfRawData, EndAddressOfRawData and SizeOfZeroFill
+	var start, end uint64
+	var zeroFill uint32
+	if l.magic == 0x20b {
+		start = binary.LittleEndian.Uint64(data[offset:])
+		end = binary.LittleEndian.Uint64(data[offset+8:])
+		zeroFill = binary.LittleEndian.Uint32(data[offset+32:])
+	} else {
+		start = uint64(binary.LittleEndian.Uint32(data[offset:]))
+		end = uint64(binary.LittleEndian.Uint32(data[offset+4:]))
+		zeroFill = binary.LittleEndian.Uint32(data[offset+16:])
+	}
+	if end-start+uint64(zeroFill) == 0 {
+		return "", nil
+	}
+	fmt.Printf("warning: DLL uses %d bytes of implicit TLS, %s does not set it up when the DLL is loaded with LoadLibrary\n",
+		end-start+uint64(zeroFill), target.Title)
+	return "", nil
+}
+
+// applyFixups runs the enabled fixups on a written file, logging every change
+func applyFixups(filePath string, target targetProfile, debug bool) error {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %v", err)
+	}
+	l, err := parseLayout(data)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for _, f := range fixups {
+		if disabledFixups[f.Name] {
+			if debug {
+				fmt.Printf("[DEBUG] fixup %s disabled (%s)\n", f.Name, f.Description)
+			}
+			continue
+		}
+		change, err := f.apply(data, l, target)
+		if err != nil {
+			fmt.Printf("warning: fixup %s failed: %v\n", f.Name, err)
+			continue
+		}
+		if change != "" {
+			fmt.Printf("fixup %s: %s\n", f.Name, change)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	if err := os.WriteFile(filePath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write fixups: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestFixLoadConfig(t *testing.T) {
+	xp, _ := findTarget("xp")
+	xp64, _ := findTarget("xp64")
+	tests := []struct {
+		name     string
+		is64     bool
+		handlers uint32
+		target   targetProfile
+		want     string
+		size     uint32
+	}{
+		{"x86", false, 0, xp, "load config directory size 0x94 -> 0x40", 0x40},
+		{"x86 with SafeSEH", false, 3, xp, "load config directory size 0x94 -> 0x40, dropping the SafeSEH table of 3 handlers (exception handlers are no longer validated)", 0x40},
+		{"x64", true, 0, xp64, "load config directory size 0x100 -> 0x70", 0x70},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := buildPE(fxSpec{Is64: tt.is64, LoadCfg: true})
+			l, err := parseLayout(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rva, _ := l.directory(data, dirLoadConfig)
+			if tt.handlers > 0 {
+				offset, err := rvaToOffset(data, rva)
+				if err != nil {
+					t.Fatal(err)
+				}
+				binary.LittleEndian.PutUint32(data[offset+loadConfigSEHandlerTable:], rva+0x200)
+				binary.LittleEndian.PutUint32(data[offset+loadConfigSEHandlerCount:], tt.handlers)
+			}
+
+			change, err := fixLoadConfig(data, l, tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if change != tt.want {
+				t.Errorf("change = %q, want %q", change, tt.want)
+			}
+			if newRVA, size := l.directory(data, dirLoadConfig); newRVA != rva || size != tt.size {
+				t.Errorf("load config directory = 0x%x, 0x%x", newRVA, size)
+			}
+		})
+	}
+}
+
+func TestFixLoadConfigKeptOnVista(t *testing.T) {
+	vistaTarget, _ := findTarget("vista")
+	data := buildPE(fxSpec{LoadCfg: true})
+	l, err := parseLayout(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change, err := fixLoadConfig(data, l, vistaTarget); err != nil || change != "" {
+		t.Errorf("change = %q, %v", change, err)
+	}
+}
+
+func TestApplyFixups(t *testing.T) {
+	dir := newTestDir(t)
+	xp, _ := findTarget("xp")
+	path := writeFixture(t, dir, "app.dll", fxSpec{Dll: true, LoadCfg: true, DllChars: dllCharGuardCF | 0x0140})
+	disabledFixups["loadconfig"] = true
+	if err := applyFixups(path, xp, false); err != nil {
+		t.Fatal(err)
+	}
+	data := readFixture(t, path)
+	l, err := parseLayout(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chars := binary.LittleEndian.Uint16(data[l.field(70):]); chars != 0x0140 {
+		t.Errorf("DllCharacteristics = 0x%04x, want 0x0140", chars)
+	}
+	if _, size := l.directory(data, dirLoadConfig); size != 0x94 {
+		t.Errorf("disabled loadconfig fixup changed the size to 0x%x", size)
+	}
+}
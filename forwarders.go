@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Size of IMAGE_EXPORT_DIRECTORY
+const exportDirectorySize = 40
+
+// exportForwarder is an export address table entry forwarding to a mapped DLL
+type exportForwarder struct {
+	Exports     []string // exports sharing the forwarder string, by name or #ordinal
+	RVA         uint32   // RVA of the forwarder string
+	Offset      uint32   // file offset of the forwarder string
+	Forwarder   string
+	Replacement string // forwarder string naming the replacement DLL
+	DLL         string // progwrp DLL the forwarder now points at
+}
+
+// exportTable is the part of the export directory forwarders are rewritten in
+type exportTable struct {
+	rva, size  uint32 // data directory 0
+	offset     uint32 // file offset of IMAGE_EXPORT_DIRECTORY
+	base       uint32
+	functions  uint32 // file offset of the export address table
+	numEntries uint32
+}
+
+// readExportTable locates the export directory of a raw PE image, returning nil when it has none
+func readExportTable(data []byte) (*exportTable, error) {
+	l, err := parseLayout(data)
+	if err != nil {
+		return nil, err
+	}
+	rva, size := l.directory(data, dirExport)
+	if rva == 0 || size == 0 {
+		return nil, nil
+	}
+	offset, err := rvaToOffset(data, rva)
+	if err != nil {
+		return nil, fmt.Errorf("export directory: %v", err)
+	}
+	if int(offset)+exportDirectorySize > len(data) {
+		return nil, fmt.Errorf("export directory at 0x%x is truncated", offset)
+	}
+	t := &exportTable{
+		rva:        rva,
+		size:       size,
+		offset:     offset,
+		base:       binary.LittleEndian.Uint32(data[offset+16:]),
+		numEntries: binary.LittleEndian.Uint32(data[offset+20:]),
+	}
+	if t.numEntries == 0 {
+		return t, nil
+	}
+	if t.functions, err = rvaToOffset(data, binary.LittleEndian.Uint32(data[offset+28:])); err != nil {
+		return nil, fmt.Errorf("export address table: %v", err)
+	}
+	if uint64(t.functions)+uint64(t.numEntries)*4 > uint64(len(data)) {
+		return nil, fmt.Errorf("export address table at 0x%x is truncated", t.functions)
+	}
+	return t, nil
+}
+
+// entry reads the i-th export address table entry
+func (t *exportTable) entry(data []byte, i uint32) uint32 {
+	return binary.LittleEndian.Uint32(data[t.functions+i*4:])
+}
+
+// isForwarder reports whether an export address points at a forwarder string. The loader
+// treats every address inside the export directory as one.
+func (t *exportTable) isForwarder(address uint32) bool {
+	return address >= t.rva && address < t.rva+t.size
+}
+
+// exportNames maps export ordinals to their names for output
+func exportNames(data []byte, t *exportTable) map[uint32]string {
+	names := make(map[uint32]string)
+	numNames := binary.LittleEndian.Uint32(data[t.offset+24:])
+	namesOffset, err := rvaToOffset(data, binary.LittleEndian.Uint32(data[t.offset+32:]))
+	if err != nil {
+		return names
+	}
+	ordinalsOffset, err := rvaToOffset(data, binary.LittleEndian.Uint32(data[t.offset+36:]))
+	if err != nil {
+		return names
+	}
+	for i := uint32(0); i < numNames; i++ {
+		if int(namesOffset+i*4+4) > len(data) || int(ordinalsOffset+i*2+2) > len(data) {
+			break
+		}
+		nameOffset, err := rvaToOffset(data, binary.LittleEndian.Uint32(data[namesOffset+i*4:]))
+		if err != nil {
+			continue
+		}
+		if name, ok := readCString(data, nameOffset, maxDllNameLength); ok {
+			names[t.base+uint32(binary.LittleEndian.Uint16(data[ordinalsOffset+i*2:]))] = name
+		}
+	}
+	return names
+}
+
+// forwarderReplacement returns the forwarder string pointing a forwarder at progwrp, or false
+// when its target is not redirected. Forwarders name the DLL without its extension, so
+// "KERNEL32.InitializeSRWLock" becomes "pwrp_k32.InitializeSRWLock".
+func forwarderReplacement(forwarder string) (string, string, error) {
+	dll, function, ok := splitForwarder(forwarder)
+	if !ok {
+		return "", "", nil
+	}
+	replacement, ok := replacementFor(dll)
+	if !ok || !redirectFunction(dll, function) || (minimalRedirect && !missingOnTarget(dll, function)) {
+		return "", "", nil
+	}
+	if strings.HasPrefix(function, "#") {
+		// Same as ordinal imports, the ordinal means another function in the replacement
+		var ordinal uint32
+		if _, err := fmt.Sscanf(function, "#%d", &ordinal); err != nil {
+			return "", "", fmt.Errorf("malformed ordinal in forwarder %q", forwarder)
+		}
+		name, err := ordinalName(dll, ordinal)
+		if err != nil {
+			return "", "", fmt.Errorf("forwarder %q: %v", forwarder, err)
+		}
+		function = name
+	}
+	module := replacement
+	if strings.EqualFold(filepath.Ext(module), ".dll") {
+		module = module[:len(module)-len(filepath.Ext(module))]
+	}
+	return module + "." + function, replacement, nil
+}
+
+// planForwarders lists the forwarder strings of an image that point at mapped DLLs.
+// Exports sharing a string are grouped, the same way import names shared by descriptors are.
+func planForwarders(data []byte) ([]*exportForwarder, error) {
+	t, err := readExportTable(data)
+	if err != nil || t == nil {
+		return nil, err
+	}
+	names := exportNames(data, t)
+
+	var forwarders []*exportForwarder
+	byRVA := make(map[uint32]*exportForwarder)
+	for i := uint32(0); i < t.numEntries; i++ {
+		address := t.entry(data, i)
+		if !t.isForwarder(address) {
+			continue
+		}
+		export := names[t.base+i]
+		if export == "" {
+			export = fmt.Sprintf("#%d", t.base+i)
+		}
+		if f, ok := byRVA[address]; ok {
+			f.Exports = append(f.Exports, export)
+			continue
+		}
+		offset, err := rvaToOffset(data, address)
+		if err != nil {
+			return nil, fmt.Errorf("forwarder of %s: %v", export, err)
+		}
+		forwarder, ok := readCString(data, offset, maxDllNameLength)
+		if !ok {
+			return nil, fmt.Errorf("forwarder of %s at offset 0x%x is not terminated", export, offset)
+		}
+		replacement, dll, err := forwarderReplacement(forwarder)
+		if err != nil {
+			return nil, fmt.Errorf("export %s: %v", export, err)
+		}
+		if replacement == "" {
+			continue
+		}
+		f := &exportForwarder{
+			Exports:     []string{export},
+			RVA:         address,
+			Offset:      offset,
+			Forwarder:   forwarder,
+			Replacement: replacement,
+			DLL:         dll,
+		}
+		byRVA[address] = f
+		forwarders = append(forwarders, f)
+	}
+	return forwarders, nil
+}
+
+// forwardersFit reports whether every replacement forwarder fits in the space of the original
+func forwardersFit(forwarders []*exportForwarder) bool {
+	for _, f := range forwarders {
+		if len(f.Replacement) > len(f.Forwarder) {
+			return false
+		}
+	}
+	return true
+}
+
+// rewriteForwarders points forwarders at the progwrp DLLs. When the new strings fit they are
+// rewritten in place. Otherwise the export directory header, the export address table and every
+// forwarder string are copied to the extra section: the loader only takes addresses inside the
+// export directory for forwarders, so the strings cannot move on their own. The name and ordinal
+// tables stay where they are.
+func rewriteForwarders(data []byte, forwarders []*exportForwarder, extra *extraSection) error {
+	for _, f := range forwarders {
+		fmt.Printf("patching export forwarder: %s -> %s -> %s\n", strings.Join(f.Exports, ", "), f.Forwarder, f.Replacement)
+	}
+	if forwardersFit(forwarders) {
+		for _, f := range forwarders {
+			if err := rewriteString(data, f.Offset, uint32(len(f.Forwarder))+1, f.Replacement); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	t, err := readExportTable(data)
+	if err != nil {
+		return err
+	}
+	l, err := parseLayout(data)
+	if err != nil {
+		return err
+	}
+	replacements := make(map[uint32]string)
+	for _, f := range forwarders {
+		replacements[f.RVA] = f.Replacement
+	}
+
+	// Adding nothing aligns the section and tells where the new directory starts
+	base := extra.add(nil, 4)
+	table := make([]byte, exportDirectorySize+t.numEntries*4)
+	copy(table, data[t.offset:t.offset+exportDirectorySize])
+	binary.LittleEndian.PutUint32(table[28:], base+exportDirectorySize)
+
+	strs := make(map[uint32]uint32) // old forwarder RVA -> new RVA
+	for i := uint32(0); i < t.numEntries; i++ {
+		address := t.entry(data, i)
+		if t.isForwarder(address) {
+			moved, ok := strs[address]
+			if !ok {
+				str, ok := replacements[address]
+				if !ok {
+					offset, err := rvaToOffset(data, address)
+					if err != nil {
+						return fmt.Errorf("forwarder of #%d: %v", t.base+i, err)
+					}
+					if str, ok = readCString(data, offset, maxDllNameLength); !ok {
+						return fmt.Errorf("forwarder of #%d at offset 0x%x is not terminated", t.base+i, offset)
+					}
+				}
+				moved = base + uint32(len(table))
+				table = append(append(table, str...), 0)
+				strs[address] = moved
+			}
+			address = moved
+		}
+		binary.LittleEndian.PutUint32(table[exportDirectorySize+i*4:], address)
+	}
+
+	if rva := extra.add(table, 1); rva != base {
+		return fmt.Errorf("export directory was placed at RVA 0x%x instead of 0x%x", rva, base)
+	}
+	fmt.Printf("moved export directory to %s to fit the longer forwarders\n", extraSectionName)
+	return l.setDirectory(data, dirExport, base, uint32(len(table)))
+}
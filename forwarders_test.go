@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func forwarderFixture(t *testing.T, is64 bool, exports []fxExport) string {
+	t.Helper()
+	dir := newTestDir(t)
+	mapping["kernel32.dll"] = "pwrp_k32.dll"
+	writeFixture(t, blobsBaseDir, fixtureArch(is64)+"/pwrp_k32.dll", fxSpec{Is64: is64, Dll: true,
+		Name: "pwrp_k32.dll", Exports: []fxExport{{Name: "InitializeSRWLock"}}})
+	return writeFixture(t, dir, "app.dll", fxSpec{Is64: is64, Dll: true, Name: "app.dll", Exports: exports,
+		Imports: []fxImport{{DLL: "user32.dll", Funcs: []string{"MessageBoxA"}}}})
+}
+
+func TestRewriteForwarders(t *testing.T) {
+	for _, is64 := range []bool{false, true} {
+		t.Run(fixtureArch(is64), func(t *testing.T) {
+			dll := forwarderFixture(t, is64, []fxExport{
+				{Name: "Run"},
+				{Name: "InitLock", Forwarder: "KERNEL32.InitializeSRWLock"},
+				{Name: "Box", Forwarder: "USER32.MessageBoxA"},
+			})
+			data := readFixture(t, patchFixture(t, dll))
+			if !bytes.Contains(data, []byte("\x00pwrp_k32.InitializeSRWLock\x00")) {
+				t.Errorf("forwarder to kernel32 was not rewritten")
+			}
+			if !bytes.Contains(data, []byte("\x00USER32.MessageBoxA\x00")) {
+				t.Errorf("forwarder to user32 was changed")
+			}
+		})
+	}
+}
+
+func TestRefuseUnresolvableForwarder(t *testing.T) {
+	dll := forwarderFixture(t, false, []fxExport{
+		{Name: "InitLock", Forwarder: "KERNEL32.InitializeSRWLock"},
+		{Name: "Tick", Forwarder: "KERNEL32.#5"},
+	})
+
+	pe, err := parsePE(dll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing, err := checkCoverage(pe, "x86")
+	pe.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 1 || missing[0].Export != "Tick" || missing[0].Function != "#5" ||
+		missing[0].Replacement != "pwrp_k32.dll" || !strings.Contains(missing[0].Reason, "pass -db") {
+		t.Fatalf("missing = %+v", missing)
+	}
+
+	err = patchFile(dll, "x86", false)
+	if err == nil || !strings.Contains(err.Error(), `cannot rewrite export forwarders: export Tick: forwarder "KERNEL32.#5"`) {
+		t.Fatalf("patchFile error = %v", err)
+	}
+	if fileExists(patchedPath(dll)) {
+		t.Errorf("patched file was written")
+	}
+}
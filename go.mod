@@ -1,5 +1,5 @@
 module github.com/matu6968/progwrp-patcher
 
-go 1.15
+go 1.16
 
 require github.com/saferwall/pe v1.5.7
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	pefile "github.com/saferwall/pe"
+)
+
+// Longest DLL name read from an import descriptor
+const maxDllNameLength = 0x200
+
+// importDescriptor is an import or delay-load descriptor whose DLL name can be redirected
+type importDescriptor struct {
+	Name      string
+	Offset    uint32 // file offset of the descriptor
+	NameField uint32 // offset of the Name field inside the descriptor
+	NameRVA   uint32
+	Delay     bool
+	NameBase  uint32 // ImageBase for old style delay-load descriptors, which store a VA
+	Functions []pefile.ImportFunction
+}
+
+// importNameRef is a DLL name string referenced by the Name field of one or more descriptors
+type importNameRef struct {
+	Name        string
+	Offset      uint32 // file offset of the string
+	Size        uint32 // length including the terminating null
+	RVA         uint32
+	Descriptors []int  // indexes into the descriptor list
+	Delay       bool   // only referenced by delay-load descriptors
+	Conflict    string // set when the string cannot be rewritten without touching another name
+}
+
+// importDescriptors lists the regular and delay-load import descriptors of a PE
+func importDescriptors(pe *pefile.File) []importDescriptor {
+	var imageBase uint32
+	if hdr, ok := pe.NtHeader.OptionalHeader.(pefile.ImageOptionalHeader32); ok {
+		imageBase = hdr.ImageBase
+	}
+
+	descs := make([]importDescriptor, 0, len(pe.Imports)+len(pe.DelayImports))
+	for _, imp := range pe.Imports {
+		descs = append(descs, importDescriptor{
+			Name:      imp.Name,
+			Offset:    imp.Offset,
+			NameField: 12,
+			NameRVA:   imp.Descriptor.Name,
+			Functions: imp.Functions,
+		})
+	}
+	for _, imp := range pe.DelayImports {
+		desc := importDescriptor{
+			Name:      imp.Name,
+			Offset:    imp.Offset,
+			NameField: 4,
+			NameRVA:   imp.Descriptor.Name,
+			Delay:     true,
+			Functions: imp.Functions,
+		}
+		// Bit 0 of Attributes (dlattrRva) clear means the descriptor holds VAs
+		if imp.Descriptor.Attributes&1 == 0 && !pe.Is64 {
+			desc.NameBase = imageBase
+			desc.NameRVA -= imageBase
+		}
+		descs = append(descs, desc)
+	}
+	return descs
+}
+
+// setName points a descriptor at a new name string
+func (d importDescriptor) setName(data []byte, rva uint32) {
+	binary.LittleEndian.PutUint32(data[d.Offset+d.NameField:], rva+d.NameBase)
+}
+
+// kind describes the descriptor in output
+func (d importDescriptor) kind() string {
+	if d.Delay {
+		return "delay-load import"
+	}
+	return "import"
+}
+
+// readCString reads a null terminated string at a file offset
+func readCString(data []byte, offset uint32, max int) (string, bool) {
+	if int(offset) >= len(data) {
+		return "", false
+	}
+	end := len(data)
+	if int(offset)+max < end {
+		end = int(offset) + max
+	}
+	n := bytes.IndexByte(data[offset:end], 0)
+	if n < 0 {
+		return "", false
+	}
+	return string(data[offset : int(offset)+n]), true
+}
+
+// collectImportNames resolves the Name RVA of every descriptor to the string it points at.
+// Descriptors sharing one string are grouped, names that cannot be located are returned as warnings.
+func collectImportNames(data []byte, descs []importDescriptor) ([]*importNameRef, []string) {
+	var warnings []string
+	byRVA := make(map[uint32]*importNameRef)
+	for i, desc := range descs {
+		rva := desc.NameRVA
+		if ref, ok := byRVA[rva]; ok {
+			ref.Descriptors = append(ref.Descriptors, i)
+			ref.Delay = ref.Delay && desc.Delay
+			continue
+		}
+		offset, err := rvaToOffset(data, rva)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("name of %s descriptor %d (%s) is not in the file: %v", desc.kind(), i, desc.Name, err))
+			continue
+		}
+		name, ok := readCString(data, offset, maxDllNameLength)
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("name of %s descriptor %d (%s) at offset 0x%x is not terminated", desc.kind(), i, desc.Name, offset))
+			continue
+		}
+		if name != desc.Name {
+			warnings = append(warnings, fmt.Sprintf("name of %s descriptor %d at offset 0x%x reads %q, expected %q", desc.kind(), i, offset, name, desc.Name))
+			continue
+		}
+		byRVA[rva] = &importNameRef{
+			Name:        name,
+			Offset:      offset,
+			Size:        uint32(len(name)) + 1,
+			RVA:         rva,
+			Descriptors: []int{i},
+			Delay:       desc.Delay,
+		}
+	}
+
+	refs := make([]*importNameRef, 0, len(byRVA))
+	for _, ref := range byRVA {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Offset < refs[j].Offset })
+
+	// A string starting inside another one (linker tail merging) cannot be rewritten
+	// without also changing the other descriptor's name
+	for i := 1; i < len(refs); i++ {
+		prev, cur := refs[i-1], refs[i]
+		if cur.Offset < prev.Offset+prev.Size {
+			prev.Conflict = fmt.Sprintf("shares its bytes with %q at offset 0x%x", cur.Name, cur.Offset)
+			cur.Conflict = fmt.Sprintf("shares its bytes with %q at offset 0x%x", prev.Name, prev.Offset)
+		}
+	}
+	return refs, warnings
+}
+
+// rewriteString replaces a null terminated string in place, padding the old space with nulls
+func rewriteString(data []byte, offset, size uint32, replacement string) error {
+	if uint32(len(replacement))+1 > size {
+		return fmt.Errorf("%s does not fit in %d bytes", replacement, size)
+	}
+	copy(data[offset:], replacement)
+	for i := offset + uint32(len(replacement)); i < offset+size; i++ {
+		data[i] = 0
+	}
+	return nil
+}
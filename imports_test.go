@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRewriteImportNameThroughDescriptor(t *testing.T) {
+	for _, is64 := range []bool{false, true} {
+		t.Run(fixtureArch(is64), func(t *testing.T) {
+			dir := newTestDir(t)
+			mapping["kernel32.dll"] = "pwrp_k32.dll"
+			writeFixture(t, blobsBaseDir, fixtureArch(is64)+"/pwrp_k32.dll", fxSpec{Is64: is64, Dll: true,
+				Name: "pwrp_k32.dll", Exports: []fxExport{{Name: "GetTickCount"}}})
+			// A byte search would also hit the copy of the name in the overlay
+			overlay := []byte("kernel32.dll\x00overlay data")
+			app := writeFixture(t, dir, "app.exe", fxSpec{Is64: is64, Overlay: overlay, Imports: []fxImport{
+				{DLL: "kernel32.dll", Funcs: []string{"GetTickCount"}},
+				{DLL: "user32.dll", Funcs: []string{"MessageBoxA"}},
+			}})
+
+			out := patchFixture(t, app)
+			want := []string{"pwrp_k32.dll!GetTickCount", "user32.dll!MessageBoxA"}
+			if got := fixtureImports(t, out); !reflect.DeepEqual(got, want) {
+				t.Errorf("imports = %v, want %v", got, want)
+			}
+			data := readFixture(t, out)
+			if !bytes.HasSuffix(data, overlay) {
+				t.Errorf("overlay was changed")
+			}
+			// The name fits in place, so nothing but the provenance record is appended
+			if names := sectionNames(t, data); strings.Join(names, " ") != ".text .rdata .data .pwrpinf" {
+				t.Errorf("sections = %v", names)
+			}
+		})
+	}
+}
+
+func TestRewriteSharedImportName(t *testing.T) {
+	dir := newTestDir(t)
+	mapping["kernel32.dll"] = "pwrp_k32.dll"
+	writeFixture(t, blobsBaseDir, "x86/pwrp_k32.dll", fxSpec{Dll: true, Name: "pwrp_k32.dll",
+		Exports: []fxExport{{Name: "GetTickCount"}, {Name: "Sleep"}}})
+	app := writeFixture(t, dir, "app.exe", fxSpec{SharedName: true, Imports: []fxImport{
+		{DLL: "kernel32.dll", Funcs: []string{"GetTickCount"}},
+		{DLL: "kernel32.dll", Funcs: []string{"Sleep"}},
+	}})
+
+	pe, err := parsePE(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs, warnings := collectImportNames(readFixture(t, app), importDescriptors(pe))
+	pe.Close()
+	if len(warnings) > 0 || len(refs) != 1 || len(refs[0].Descriptors) != 2 {
+		t.Fatalf("refs = %+v, warnings = %v", refs, warnings)
+	}
+
+	out := patchFixture(t, app)
+	want := []string{"pwrp_k32.dll!GetTickCount", "pwrp_k32.dll!Sleep"}
+	if got := fixtureImports(t, out); !reflect.DeepEqual(got, want) {
+		t.Errorf("imports = %v, want %v", got, want)
+	}
+}
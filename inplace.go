@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Write patched binaries under their own name, keeping the originals as backups
+var inPlace bool
+
+// Directory the originals are moved to with -inplace, mirroring the input layout. When empty
+// they are kept next to the patched file as name.orig.
+var backupDir string
+
+// Name of the journal an -inplace run writes to the input directory
+const journalFileName = "progwrp-journal.json"
+
+// patchJournal records what -inplace runs changed, so the restore command undoes exactly that.
+// Paths are relative to the directory of the journal.
+type patchJournal struct {
+	Files   []journalFile `json:"files"`
+	Blobs   []string      `json:"blobs"`   // progwrp DLLs that did not exist before
+	Records []string      `json:"records"` // undo records of the patched files
+	path    string
+}
+
+// journalFile is a binary patched in place and where its original was kept
+type journalFile struct {
+	Path   string `json:"path"`
+	Backup string `json:"backup"`
+}
+
+// Journal of the running -inplace patch, nil otherwise
+var journal *patchJournal
+
+// fileExists reports whether a path exists
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// backupPath returns where the original of a file patched in place is kept
+func backupPath(path string) string {
+	if backupDir == "" {
+		return path + ".orig"
+	}
+	rel, err := filepath.Rel(inputRoot, path)
+	if err != nil {
+		rel = filepath.Base(path)
+	}
+	return filepath.Join(backupDir, rel)
+}
+
+// openJournal reads the journal of earlier -inplace runs, so a new run adds to it, or starts a new one
+func openJournal(path string) (*patchJournal, error) {
+	j := &patchJournal{path: path}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return j, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read journal: %v", err)
+	}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, fmt.Errorf("failed to decode journal %s: %v", path, err)
+	}
+	return j, nil
+}
+
+// save writes the journal next to the old one and swaps it in, so an interrupted run still
+// leaves a complete journal of everything changed before
+func (j *patchJournal) save() error {
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode journal: %v", err)
+	}
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write journal: %v", err)
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return fmt.Errorf("failed to write journal: %v", err)
+	}
+	return nil
+}
+
+// rel turns a path into the form stored in the journal
+func (j *patchJournal) rel(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	dir, err := filepath.Abs(filepath.Dir(j.path))
+	if err != nil {
+		return abs
+	}
+	if rel, err := filepath.Rel(dir, abs); err == nil {
+		return filepath.ToSlash(rel)
+	}
+	return abs
+}
+
+// resolve turns a path stored in the journal back into one that can be opened
+func (j *patchJournal) resolve(path string) string {
+	path = filepath.FromSlash(path)
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(j.path), path)
+}
+
+// addFile records a file patched in place and saves the journal
+func (j *patchJournal) addFile(path, backup string) error {
+	j.Files = append(j.Files, journalFile{Path: j.rel(path), Backup: j.rel(backup)})
+	return j.save()
+}
+
+// dropFile forgets the last record of a file, when patching it failed after the backup was made
+func (j *patchJournal) dropFile(path string) error {
+	rel := j.rel(path)
+	for i := len(j.Files) - 1; i >= 0; i-- {
+		if j.Files[i].Path == rel {
+			j.Files = append(j.Files[:i], j.Files[i+1:]...)
+			return j.save()
+		}
+	}
+	return nil
+}
+
+// changed reports whether the journal already records a path as patched or deployed
+func (j *patchJournal) changed(path string) bool {
+	rel := j.rel(path)
+	for _, f := range j.Files {
+		if f.Path == rel {
+			return true
+		}
+	}
+	for _, blob := range j.Blobs {
+		if blob == rel {
+			return true
+		}
+	}
+	return false
+}
+
+// addBlob records a progwrp DLL deployed by the run and saves the journal
+func (j *patchJournal) addBlob(path string) error {
+	j.Blobs = append(j.Blobs, j.rel(path))
+	return j.save()
+}
+
+// addRecord records the undo record written for a file and saves the journal
+func (j *patchJournal) addRecord(path string) error {
+	j.Records = append(j.Records, j.rel(path))
+	return j.save()
+}
+
+// moveFile renames a file, copying it when the destination is on another volume
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// backupOriginal moves the original of a file about to be patched in place to its backup and
+// records it in the journal
+func backupOriginal(path string) (string, error) {
+	backup := backupPath(path)
+	if fileExists(backup) {
+		return "", fmt.Errorf("backup %s already exists, restore it before patching again", backup)
+	}
+	if err := os.MkdirAll(filepath.Dir(backup), 0755); err != nil {
+		return "", fmt.Errorf("failed to create backup directory: %v", err)
+	}
+	if err := moveFile(path, backup); err != nil {
+		return "", fmt.Errorf("failed to back up original: %v", err)
+	}
+	if err := journal.addFile(path, backup); err != nil {
+		moveFile(backup, path)
+		return "", err
+	}
+	return backup, nil
+}
+
+// undoBackup puts an original back when writing its patched content failed
+func undoBackup(path, backup string) {
+	if err := moveFile(backup, path); err != nil {
+		fmt.Printf("warning: failed to put back %s from %s: %v\n", path, backup, err)
+		return
+	}
+	if err := journal.dropFile(path); err != nil {
+		fmt.Printf("warning: %v\n", err)
+	}
+}
+
+// restoreJournal puts back every original recorded in a journal and removes the progwrp DLLs
+// the runs added. Every entry is dropped from the journal as soon as it was undone, so running
+// restore again after a failure only retries what is left. The journal is removed once empty.
+func restoreJournal(j *patchJournal) error {
+	var problems int
+	restored := 0
+	// Later runs could only back up files restored by earlier ones, so undo in reverse
+	for i := len(j.Files) - 1; i >= 0; i-- {
+		path, backup := j.resolve(j.Files[i].Path), j.resolve(j.Files[i].Backup)
+		if !fileExists(backup) && fileExists(path) {
+			fmt.Printf("%s was already restored\n", path)
+		} else if err := moveFile(backup, path); err != nil {
+			fmt.Printf("warning: failed to restore %s from %s: %v\n", path, backup, err)
+			problems++
+			continue
+		} else {
+			fmt.Printf("restored %s\n", path)
+			restored++
+		}
+		j.Files = append(j.Files[:i], j.Files[i+1:]...)
+		if err := j.save(); err != nil {
+			return err
+		}
+	}
+
+	removed := 0
+	for i := 0; i < len(j.Blobs); {
+		path := j.resolve(j.Blobs[i])
+		if err := os.Remove(path); err == nil {
+			fmt.Printf("removed %s\n", path)
+			removed++
+		} else if !os.IsNotExist(err) {
+			fmt.Printf("warning: failed to remove %s: %v\n", path, err)
+			problems++
+			i++
+			continue
+		}
+		j.Blobs = append(j.Blobs[:i], j.Blobs[i+1:]...)
+		if err := j.save(); err != nil {
+			return err
+		}
+	}
+
+	// The undo records describe patched files that are gone now
+	for i := 0; i < len(j.Records); {
+		path := j.resolve(j.Records[i])
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("warning: failed to remove %s: %v\n", path, err)
+			problems++
+			i++
+			continue
+		}
+		j.Records = append(j.Records[:i], j.Records[i+1:]...)
+		if err := j.save(); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("restored %d files, removed %d progwrp DLLs\n", restored, removed)
+	if problems > 0 {
+		return fmt.Errorf("%d files could not be restored, keeping the rest in the journal %s", problems, j.path)
+	}
+	return os.Remove(j.path)
+}
+
+// runRestore implements the restore command
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	input := fs.String("i", ".", "directory that was patched with -inplace")
+	journalPath := fs.String("journal", "", "journal written by the -inplace run (default "+journalFileName+" in the input directory)")
+	fs.Parse(args)
+
+	if *journalPath == "" {
+		*journalPath = filepath.Join(*input, journalFileName)
+	}
+	if !fileExists(*journalPath) {
+		return fmt.Errorf("no journal at %s, nothing was patched in place there", *journalPath)
+	}
+	j, err := openJournal(*journalPath)
+	if err != nil {
+		return err
+	}
+	return restoreJournal(j)
+}
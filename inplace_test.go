@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// patchInPlace patches every binary below input in place the way the main command does
+func patchInPlace(t *testing.T, input string) {
+	t.Helper()
+	inPlace = true
+	if err := setInputRoot(input); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if journal, err = openJournal(filepath.Join(input, journalFileName)); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := collectFiles(input, true)
+	patchFiles(files, "", false)
+	journal = nil
+}
+
+func TestInPlaceRestoreRecursive(t *testing.T) {
+	dir := newTestDir(t)
+	mapping["kernel32.dll"] = "pwrp_k32.dll"
+	blob := writeFixture(t, blobsBaseDir, "x86/pwrp_k32.dll", fxSpec{Dll: true, Name: "pwrp_k32.dll",
+		Exports: []fxExport{{Name: "GetTickCount64"}}})
+	input := filepath.Join(dir, "in")
+	kernel32 := []fxImport{{DLL: "kernel32.dll", Funcs: []string{"GetTickCount64"}}}
+	writeFixture(t, input, "app.exe", fxSpec{Imports: kernel32})
+	writeFixture(t, input, "plugins/plugin.dll", fxSpec{Dll: true, Name: "plugin.dll", Imports: kernel32})
+	writeFixture(t, input, "tools/tool.exe", fxSpec{Imports: kernel32})
+	// An older copy shipped with the application is replaced by the blob and must come back
+	writeFixture(t, input, "tools/pwrp_k32.dll", fxSpec{Dll: true, Name: "pwrp_k32.dll",
+		Exports: []fxExport{{Name: "OldExport"}}})
+	writeFixture(t, input, "lib/plain.dll", fxSpec{Dll: true, Name: "plain.dll", Imports: []fxImport{
+		{DLL: "user32.dll", Funcs: []string{"MessageBoxA"}},
+	}})
+	if err := os.WriteFile(filepath.Join(input, "readme.txt"), []byte("readme"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before := treeFiles(t, input)
+
+	patchInPlace(t, input)
+
+	for _, name := range []string{"app.exe", "plugins/plugin.dll", "tools/tool.exe"} {
+		got := fixtureImports(t, filepath.Join(input, filepath.FromSlash(name)))
+		if !reflect.DeepEqual(got, []string{"pwrp_k32.dll!GetTickCount64"}) {
+			t.Errorf("%s imports = %v", name, got)
+		}
+	}
+	for _, name := range []string{"pwrp_k32.dll", "tools/pwrp_k32.dll"} {
+		if !bytes.Equal(readFixture(t, filepath.Join(input, filepath.FromSlash(name))), readFixture(t, blob)) {
+			t.Errorf("%s is not the blob", name)
+		}
+	}
+
+	if err := runRestore([]string{"-i", input}); err != nil {
+		t.Fatal(err)
+	}
+	if after := treeFiles(t, input); !reflect.DeepEqual(after, before) {
+		for name := range after {
+			if !bytes.Equal(after[name], before[name]) {
+				t.Errorf("%s differs from the original after restore", name)
+			}
+		}
+		for name := range before {
+			if _, ok := after[name]; !ok {
+				t.Errorf("%s is missing after restore", name)
+			}
+		}
+	}
+}
+
+func TestRestoreResumesAfterFailure(t *testing.T) {
+	dir := newTestDir(t)
+	mapping["kernel32.dll"] = "pwrp_k32.dll"
+	writeFixture(t, blobsBaseDir, "x86/pwrp_k32.dll", fxSpec{Dll: true, Name: "pwrp_k32.dll",
+		Exports: []fxExport{{Name: "GetTickCount64"}}})
+	kernel32 := []fxImport{{DLL: "kernel32.dll", Funcs: []string{"GetTickCount64"}}}
+	app := writeFixture(t, dir, "app.exe", fxSpec{Imports: kernel32})
+	lib := writeFixture(t, dir, "lib.dll", fxSpec{Dll: true, Name: "lib.dll", Imports: kernel32})
+	before := treeFiles(t, dir)
+	delete(before, "blobs/x86/pwrp_k32.dll")
+
+	patchInPlace(t, dir)
+
+	// A restore interrupted after putting lib.dll back, before the journal was saved
+	if err := moveFile(backupPath(lib), lib); err != nil {
+		t.Fatal(err)
+	}
+	// Something in the way of app.exe makes its restore fail
+	if err := os.Remove(app); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(app, "busy"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := runRestore([]string{"-i", dir}); err == nil {
+		t.Fatal("restore succeeded with app.exe in the way")
+	}
+
+	j, err := openJournal(filepath.Join(dir, journalFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []journalFile{{Path: "app.exe", Backup: "app.exe.orig"}}
+	if !reflect.DeepEqual(j.Files, want) || len(j.Blobs) != 0 || len(j.Records) != 0 {
+		t.Fatalf("journal after the failed restore = %+v, want only %+v", j, want)
+	}
+
+	if err := os.RemoveAll(app); err != nil {
+		t.Fatal(err)
+	}
+	if err := runRestore([]string{"-i", dir}); err != nil {
+		t.Fatal(err)
+	}
+	after := treeFiles(t, dir)
+	delete(after, "blobs/x86/pwrp_k32.dll")
+	if !reflect.DeepEqual(after, before) {
+		t.Errorf("tree after restore = %v, want %v", keys(after), keys(before))
+	}
+}
+
+// keys returns the names of a file tree for messages
+func keys(files map[string][]byte) []string {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	return names
+}
@@ -9,6 +9,7 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
 	"strings"
@@ -22,19 +23,23 @@ var mapping map[string]string
 // Base directory where helper blobs are stored
 var blobsBaseDir string
 
-// parseIni loads the DLL replacement mappings from the .ini file using a simple custom parser
-func parseIni(path string) error {
-	file, err := os.Open(path)
-	if err != nil {
-		return fmt.Errorf("failed to open ini file: %v", err)
-	}
-	defer file.Close()
+// Only report imports missing from the blobs instead of patching
+var checkOnly bool
 
-	mapping = make(map[string]string)
-	scanner := bufio.NewScanner(file)
+// parseIni layers the DLL replacement mappings of one .ini file over the ones already loaded,
+// using a simple custom parser. Every malformed line and invalid value is collected and reported
+// with its line number, unknown keys only print a warning so newer or third-party ini files load.
+func parseIni(name string, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
 	currentSection := ""
+	lineNo := 0
+	var problems []string
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("%s:%d: ", name, lineNo)+fmt.Sprintf(format, args...))
+	}
 
 	for scanner.Scan() {
+		lineNo++
 		line := strings.TrimSpace(scanner.Text())
 
 		// Skip empty lines and comments
@@ -43,30 +48,71 @@ func parseIni(path string) error {
 		}
 
 		// Check if this is a section header
-		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
-			currentSection = strings.ToLower(strings.Trim(line, "[]"))
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.TrimSpace(line[1:len(line)-1]) == "" {
+				report("malformed section header %q", line)
+				currentSection = ""
+				continue
+			}
+			currentSection = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			// Sections like [api-ms-win-core-synch-*] match DLL names by glob pattern
+			if isPattern(currentSection) {
+				if _, err := path.Match(currentSection, ""); err != nil {
+					report("invalid pattern [%s]: %v", currentSection, err)
+					currentSection = ""
+					continue
+				}
+			}
+			addSectionSource(currentSection, name, lineNo)
 			continue
 		}
 
 		// Parse key-value pairs
-		if strings.Contains(line, "=") && currentSection != "" {
-			parts := strings.SplitN(line, "=", 2)
-			if len(parts) == 2 {
-				key := strings.TrimSpace(parts[0])
-				value := strings.TrimSpace(parts[1])
-
-				// Only store ReplacementName entries
-				if strings.ToLower(key) == "replacementname" {
-					mapping[currentSection] = value
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			report("expected key=value or [section], got %q", line)
+			continue
+		}
+		if currentSection == "" {
+			report("key %q outside of a section", strings.TrimSpace(parts[0]))
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+
+		switch strings.ToLower(key) {
+		case "replacementname":
+			if value == "" {
+				report("empty ReplacementName in [%s]", currentSection)
+			} else if isPattern(currentSection) {
+				setPatternReplacement(currentSection, value)
+			} else {
+				mapping[currentSection] = value
+			}
+		case "functions":
+			// Functions moved to the replacement DLL in -split mode
+			functions := make(map[string]bool)
+			for _, fn := range strings.Split(value, ",") {
+				if fn = strings.TrimSpace(fn); fn != "" {
+					functions[fn] = true
 				}
 			}
+			splitFunctions[currentSection] = functions
+		case "arch", "targets", "enabled", "note":
+			if err := sectionCondition(currentSection).set(strings.ToLower(key), value); err != nil {
+				report("%v in [%s]", err, currentSection)
+			}
+		default:
+			fmt.Printf("warning: %s:%d: unknown key %q in [%s], ignoring it\n", name, lineNo, key, currentSection)
 		}
 	}
 
 	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading ini file: %v", err)
+		return fmt.Errorf("error reading ini file %s: %v", name, err)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid ini file:\n  %s", strings.Join(problems, "\n  "))
 	}
-
 	return nil
 }
 
@@ -110,6 +156,7 @@ func fetchBlobs(repo, arch string) error {
 	if resp.StatusCode != 200 {
 		return fmt.Errorf("failed to download blobs for %s: %s", arch, resp.Status)
 	}
+	tag := redirectedReleaseTag(resp)
 
 	if _, err := io.Copy(tmpFile, resp.Body); err != nil {
 		return err
@@ -146,13 +193,49 @@ func fetchBlobs(repo, arch string) error {
 		src.Close()
 		dst.Close()
 	}
+	if tag != "" {
+		if err := os.WriteFile(filepath.Join(targetDir, blobReleaseFile), []byte(tag+"\n"), 0644); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 // copyBlob copies a helper DLL from the arch-specific blobs directory
 func copyBlob(arch, name, targetDir string) error {
-	s := filepath.Join(blobsBaseDir, arch, name)
 	d := filepath.Join(targetDir, name)
+	existed := fileExists(d)
+	// With -o the application directory may not have been mirrored yet
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		return err
+	}
+	// A DLL of that name the application shipped is kept like a patched original, so restore puts it back
+	backup := ""
+	if journal != nil && existed && !deployedBlobs[d] && !journal.changed(d) {
+		var err error
+		if backup, err = backupOriginal(d); err != nil {
+			return err
+		}
+	}
+	if err := copyFile(filepath.Join(blobsBaseDir, arch, name), d); err != nil {
+		if backup != "" {
+			undoBackup(d, backup)
+		}
+		return err
+	}
+	deployedBlobs[d] = true
+
+	// restore only removes the DLLs this run added
+	if journal != nil && !existed {
+		if err := journal.addBlob(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies a file, replacing the destination if it exists
+func copyFile(s, d string) error {
 	in, err := os.Open(s)
 	if err != nil {
 		return err
@@ -175,6 +258,11 @@ func isProgwrpFile(filename string) bool {
 			return true
 		}
 	}
+	for _, p := range mappingPatterns {
+		if strings.EqualFold(filepath.Base(filename), p.Replacement) {
+			return true
+		}
+	}
 	return false
 }
 
@@ -203,8 +291,8 @@ func rvaToOffset(data []byte, rva uint32) (uint32, error) {
 	return 0, fmt.Errorf("RVA 0x%x not found in any section", rva)
 }
 
-// patchVersionFields patches the PE Optional Header version fields for XP compatibility
-func patchVersionFields(filePath string, debug bool) error {
+// patchVersionFields patches the PE Optional Header version fields for the target OS
+func patchVersionFields(filePath string, target targetProfile, debug bool) error {
 	// Read the file data
 	data, err := os.ReadFile(filePath)
 	if err != nil {
@@ -247,10 +335,10 @@ func patchVersionFields(filePath string, debug bool) error {
 				binary.LittleEndian.Uint16(data[majorSubVerOff:majorSubVerOff+2]),
 				binary.LittleEndian.Uint16(data[minorSubVerOff:minorSubVerOff+2]))
 		}
-		binary.LittleEndian.PutUint16(data[majorOSVerOff:majorOSVerOff+2], 5)
-		binary.LittleEndian.PutUint16(data[minorOSVerOff:minorOSVerOff+2], 1)
-		binary.LittleEndian.PutUint16(data[majorSubVerOff:majorSubVerOff+2], 5)
-		binary.LittleEndian.PutUint16(data[minorSubVerOff:minorSubVerOff+2], 1)
+		binary.LittleEndian.PutUint16(data[majorOSVerOff:majorOSVerOff+2], target.Version.Major)
+		binary.LittleEndian.PutUint16(data[minorOSVerOff:minorOSVerOff+2], target.Version.Minor)
+		binary.LittleEndian.PutUint16(data[majorSubVerOff:majorSubVerOff+2], target.Version.Major)
+		binary.LittleEndian.PutUint16(data[minorSubVerOff:minorSubVerOff+2], target.Version.Minor)
 		if debug {
 			fmt.Printf("[DEBUG] After: majorOS=%d minorOS=%d majorSub=%d minorSub=%d\n",
 				binary.LittleEndian.Uint16(data[majorOSVerOff:majorOSVerOff+2]),
@@ -258,7 +346,7 @@ func patchVersionFields(filePath string, debug bool) error {
 				binary.LittleEndian.Uint16(data[majorSubVerOff:majorSubVerOff+2]),
 				binary.LittleEndian.Uint16(data[minorSubVerOff:minorSubVerOff+2]))
 		}
-		fmt.Printf("patched subsystem/OS version to 5.1 (XP)\n")
+		fmt.Printf("patched subsystem/OS version to %s (%s)\n", target.Version, target.Title)
 
 		// Write the version-patched data back to the file
 		if err := os.WriteFile(filePath, data, 0644); err != nil {
@@ -270,12 +358,23 @@ func patchVersionFields(filePath string, debug bool) error {
 }
 
 func patchFile(path, arch string, debug bool) error {
+	target, err := resolveTarget(arch)
+	if err != nil {
+		return err
+	}
+	targetVersion = target.Version
+	targetArch = arch
+	targetProfileName = target.Name
+
 	// Read the entire file
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return fmt.Errorf("failed to read file: %v", err)
 	}
 
+	// Kept for the undo record, since data is patched in place
+	original := append([]byte(nil), data...)
+
 	// Open with saferwall/pe
 	pe, err := pefile.New(path, &pefile.Options{Fast: false})
 	if err != nil {
@@ -285,7 +384,26 @@ func patchFile(path, arch string, debug bool) error {
 		return fmt.Errorf("failed to parse PE file: %v", err)
 	}
 
+	// Find imports the progwrp blobs cannot satisfy before touching the file
+	missing, err := checkCoverage(pe, arch)
+	if err != nil {
+		fmt.Printf("warning: coverage check failed for %s: %v\n", path, err)
+	} else if len(missing) > 0 || checkOnly {
+		reportCoverage(path, missing)
+	}
+	reportContracts(path, importDescriptors(pe))
+	if checkOnly {
+		return nil
+	}
+
+	// Patching breaks any Authenticode signature
+	signed, err := checkSignature(pe, data, path)
+	if err != nil {
+		return err
+	}
+
 	patched := false
+	var extra *extraSection   // Data that did not fit in place, appended as a new section
 	var importedDlls []string // Track which DLLs will be imported after patching
 	var progwrpDlls []string  // Track only the progwrp DLLs we need to copy
 
@@ -410,119 +528,233 @@ func patchFile(path, arch string, debug bool) error {
 		fmt.Printf("[DEBUG] OptionalHeader is nil\n")
 	}
 
-	for _, imp := range pe.Imports {
-		origDLL := imp.Name
-		lowDLL := strings.ToLower(origDLL)
-		if replacement, ok := mapping[lowDLL]; ok {
-			fmt.Printf("patching import: %s -> %s\n", origDLL, replacement)
+	// Follow each descriptor's Name RVA to the exact string the loader reads
+	descs := importDescriptors(pe)
+	nameRefs, warnings := collectImportNames(data, descs)
+	for _, w := range warnings {
+		fmt.Printf("warning: %s\n", w)
+	}
 
-			needle := []byte(origDLL + "\x00")
-			replacementBytes := []byte(replacement + "\x00")
-			if len(replacementBytes) > len(needle) {
-				fmt.Printf("warning: replacement name too long for %s, skipping\n", origDLL)
+	// Bound addresses would point into the DLLs that are no longer imported
+	if err := unbindImports(data, descs); err != nil {
+		return fmt.Errorf("failed to unbind imports: %v", err)
+	}
+
+	// In -minimal mode DLLs whose imported functions all exist on the target keep their name
+	native := make(map[int]bool)
+	if minimalRedirect {
+		needed := neededRedirects(descs)
+		for i, desc := range descs {
+			lowDLL := strings.ToLower(desc.Name)
+			if _, ok := replacementFor(desc.Name); ok && !needed[lowDLL] {
+				fmt.Printf("keeping %s: %s (all %d functions exist on %s)\n", desc.kind(), desc.Name, len(desc.Functions), targetVersion)
+				native[i] = true
+			}
+		}
+	}
+
+	// In -split mode descriptors keeping some functions on the original DLL are rebuilt instead of renamed
+	splits := make(map[int]map[uint32]bool)
+	splitReplacements := make(map[int]string)
+	if splitImports {
+		for i, desc := range descs {
+			replacement, ok := replacementFor(desc.Name)
+			if !ok || native[i] {
 				continue
 			}
+			moved := planSplit(desc)
+			if len(moved) == 0 {
+				fmt.Printf("keeping %s: %s (all %d functions are native)\n", desc.kind(), desc.Name, len(desc.Functions))
+				native[i] = true
+			} else if len(moved) < len(desc.Functions) && desc.Delay {
+				// The delay-load thunks pass the address of their descriptor to the helper, so it cannot be replaced
+				return fmt.Errorf("cannot split delay-load import %s: %d of its %d functions go to %s, redirect all of them with Functions= or patch without -split",
+					desc.Name, len(moved), len(desc.Functions), replacement)
+			} else if len(moved) < len(desc.Functions) {
+				fmt.Printf("splitting import: %s -> %d functions to %s, %d stay on %s\n",
+					desc.Name, len(moved), replacement, len(desc.Functions)-len(moved), desc.Name)
+				splits[i] = moved
+				splitReplacements[i] = replacement
+			}
+		}
+		if len(splits) > 0 && extra == nil {
+			if extra, err = newExtraSection(data); err != nil {
+				fmt.Printf("warning: cannot add a section for split imports: %v, redirecting whole DLLs\n", err)
+				splits = make(map[int]map[uint32]bool)
+			}
+		}
+	}
 
-			// Count total occurrences in the file for debugging
-			if debug {
-				count := 0
-				for i := uint32(0); i < uint32(len(data))-uint32(len(needle)); i++ {
-					if string(data[i:i+uint32(len(needle))]) == string(needle) {
-						count++
-					}
-				}
-				fmt.Printf("[DEBUG] Found %d total occurrences of %s in file\n", count, origDLL)
-			}
-
-			foundAndPatched := false
-			// Search within import table bounds if available, otherwise full file
-			searchStart := uint32(0)
-			searchEnd := uint32(len(data))
-
-			if importTableStart != 0 && importTableEnd != 0 && importTableEnd > importTableStart {
-				// Expand search to include nearby sections that might contain import strings
-				// Import table usually just contains descriptors, strings are in .rdata/.idata
-				searchStart = importTableStart
-				// Expand search area to cover potential string sections
-				if importTableEnd+0x10000 < uint32(len(data)) {
-					searchEnd = importTableEnd + 0x10000 // Search 64KB after import table
-				} else {
-					searchEnd = uint32(len(data))
-				}
-				if debug {
-					fmt.Printf("[DEBUG] Searching for %s in expanded import region 0x%x - 0x%x\n", origDLL, searchStart, searchEnd)
-				}
-			} else {
-				if debug {
-					fmt.Printf("[DEBUG] Searching for %s in entire file (import table bounds not available)\n", origDLL)
-				}
+	// Ordinals mean something else in the replacement DLL, so redirected ordinal imports go by name
+	for i, desc := range descs {
+		if _, ok := replacementFor(desc.Name); !ok || native[i] || !hasOrdinalImports(desc, splits[i]) {
+			continue
+		}
+		if extra == nil {
+			if extra, err = newExtraSection(data); err != nil {
+				return fmt.Errorf("cannot add a section for the names of ordinal imports: %v", err)
 			}
+		}
+		if err := importOrdinalsByName(data, desc, splits[i], pe.Is64, extra); err != nil {
+			return err
+		}
+	}
 
-			for i := searchStart; i < searchEnd-uint32(len(needle)); i++ {
-				if string(data[i:i+uint32(len(needle))]) == string(needle) {
-					if debug {
-						fmt.Printf("[DEBUG] Found %s at offset 0x%x\n", origDLL, i)
-					}
-					copy(data[i:i+uint32(len(replacementBytes))], replacementBytes)
-					for j := i + uint32(len(replacementBytes)); j < i+uint32(len(needle)); j++ {
-						data[j] = 0
-					}
-					foundAndPatched = true
-					patched = true
-					if debug {
-						// Verify the replacement
-						replacedName := string(data[i : i+uint32(len(replacement))])
-						fmt.Printf("[DEBUG] Verified replacement: %s -> %s\n", origDLL, replacedName)
-					}
-					break // Only patch first occurrence within region
-				}
+	// Export forwarders to mapped DLLs would send callers of this DLL around progwrp
+	forwarders, err := planForwarders(data)
+	if err != nil {
+		return fmt.Errorf("cannot rewrite export forwarders: %v", err)
+	}
+	if len(forwarders) > 0 && !forwardersFit(forwarders) && extra == nil {
+		if extra, err = newExtraSection(data); err != nil {
+			return fmt.Errorf("cannot add a section for export forwarders: %v", err)
+		}
+	}
+	if len(forwarders) > 0 {
+		if err := rewriteForwarders(data, forwarders, extra); err != nil {
+			return fmt.Errorf("failed to rewrite export forwarders: %v", err)
+		}
+		deployed := make(map[string]bool)
+		for _, f := range forwarders {
+			if lowDLL := strings.ToLower(f.DLL); !deployed[lowDLL] {
+				deployed[lowDLL] = true
+				progwrpDlls = append(progwrpDlls, lowDLL)
 			}
+		}
+		patched = true
+	}
 
-			if !foundAndPatched {
-				if debug {
-					fmt.Printf("[DEBUG] Not found in constrained region, trying full file search for %s\n", origDLL)
-				}
-				// Fallback to full file search if constrained search failed
-				for i := uint32(0); i < uint32(len(data))-uint32(len(needle)); i++ {
-					if string(data[i:i+uint32(len(needle))]) == string(needle) {
-						if debug {
-							fmt.Printf("[DEBUG] Found %s at offset 0x%x (full file search)\n", origDLL, i)
-						}
-						copy(data[i:i+uint32(len(replacementBytes))], replacementBytes)
-						for j := i + uint32(len(replacementBytes)); j < i+uint32(len(needle)); j++ {
-							data[j] = 0
-						}
-						foundAndPatched = true
-						patched = true
-						if debug {
-							// Verify the replacement
-							replacedName := string(data[i : i+uint32(len(replacement))])
-							fmt.Printf("[DEBUG] Verified replacement: %s -> %s (full file search)\n", origDLL, replacedName)
-						}
-						break // Only patch first occurrence
-					}
-				}
+	for _, ref := range nameRefs {
+		origDLL := ref.Name
+		lowDLL := strings.ToLower(origDLL)
+		replacement, ok := replacementFor(origDLL)
+		appDLL := false
+		if !ok {
+			// DLLs of the application itself that were patched next to this file
+			replacement, ok = appDllRenames[lowDLL]
+			appDLL = ok
+		}
+		if !ok {
+			// Keep track of DLLs that weren't replaced
+			importedDlls = append(importedDlls, lowDLL)
+			continue
+		}
+
+		// Descriptors keeping functions on the original DLL must not see the new name
+		var renamed []int
+		for _, i := range ref.Descriptors {
+			if !native[i] && splits[i] == nil {
+				renamed = append(renamed, i)
 			}
+		}
+		if len(renamed) == 0 {
+			importedDlls = append(importedDlls, lowDLL)
+			continue
+		}
+		shared := len(renamed) < len(ref.Descriptors)
+		kind := "import"
+		if ref.Delay {
+			kind = "delay-load import"
+		}
+		if len(ref.Descriptors) > 1 {
+			fmt.Printf("patching %s: %s -> %s (name shared by %d descriptors)\n", kind, origDLL, replacement, len(ref.Descriptors))
+		} else {
+			fmt.Printf("patching %s: %s -> %s\n", kind, origDLL, replacement)
+		}
+		if debug {
+			fmt.Printf("[DEBUG] Name RVA 0x%x -> offset 0x%x\n", ref.RVA, ref.Offset)
+		}
 
-			if !foundAndPatched {
-				fmt.Printf("warning: could not find %s in import table, skipping\n", origDLL)
-				continue
+		if ref.Conflict != "" || shared || len(replacement)+1 > int(ref.Size) {
+			// The new name goes into an appended section and the descriptors are repointed at it
+			if ref.Conflict != "" {
+				fmt.Printf("name of %s %s, moving it to a new section\n", origDLL, ref.Conflict)
+			} else if shared {
+				fmt.Printf("name of %s is shared with descriptors that keep it, moving the new name to a new section\n", origDLL)
+			} else {
+				fmt.Printf("replacement name longer than %s, moving it to a new section\n", origDLL)
+			}
+			if extra == nil {
+				if extra, err = newExtraSection(data); err != nil {
+					fmt.Printf("warning: cannot add a section for %s: %v, skipping\n", origDLL, err)
+					importedDlls = append(importedDlls, lowDLL)
+					continue
+				}
+			}
+			nameRVA := extra.addString(replacement)
+			for _, i := range renamed {
+				descs[i].setName(data, nameRVA)
+			}
+			if debug {
+				fmt.Printf("[DEBUG] New name RVA 0x%x\n", nameRVA)
 			}
+		} else if err := rewriteString(data, ref.Offset, ref.Size, replacement); err != nil {
+			fmt.Printf("warning: failed to rewrite %s: %v, skipping\n", origDLL, err)
+			importedDlls = append(importedDlls, lowDLL)
+			continue
+		}
+		patched = true
 
-			// Add the replacement DLL to our list
-			importedDlls = append(importedDlls, strings.ToLower(replacement))
+		// Add the replacement DLL to our list
+		importedDlls = append(importedDlls, strings.ToLower(replacement))
+		if !appDLL {
 			progwrpDlls = append(progwrpDlls, strings.ToLower(replacement))
-		} else {
-			// Keep track of DLLs that weren't replaced
-			importedDlls = append(importedDlls, lowDLL)
 		}
 	}
+
+	if len(splits) > 0 {
+		if importTableStart == 0 {
+			return fmt.Errorf("cannot split imports: import table not found")
+		}
+		if err := rebuildImportTable(data, importTableStart, descs, splits, splitReplacements, extra); err != nil {
+			return fmt.Errorf("failed to rebuild import table: %v", err)
+		}
+		for i := range splits {
+			importedDlls = append(importedDlls, strings.ToLower(descs[i].Name), strings.ToLower(splitReplacements[i]))
+			progwrpDlls = append(progwrpDlls, strings.ToLower(splitReplacements[i]))
+		}
+		patched = true
+	}
+
 	if patched {
+		if signed && signedPolicy == "strip" {
+			if data, err = stripSignature(data); err != nil {
+				return fmt.Errorf("failed to strip signature: %v", err)
+			}
+		}
+		if extra != nil {
+			if data, err = extra.appendTo(data); err != nil {
+				return fmt.Errorf("failed to append %s section: %v", extraSectionName, err)
+			}
+			fmt.Printf("added section %s at RVA 0x%x (%d bytes)\n", extraSectionName, extra.rva, len(extra.data))
+		}
+		if stamped, err := addProvenance(data, newProvenance(original, arch, target)); err != nil {
+			fmt.Printf("warning: cannot add the provenance record: %v\n", err)
+		} else {
+			data = stamped
+		}
+
 		// Write to a new file to avoid file lock issues
-		outPath := path[:len(path)-len(filepath.Ext(path))] + "_patched" + filepath.Ext(path)
+		outPath := patchedPath(path)
+		var backup string
+		if inPlace {
+			// The mapped input has to be released before it can be moved
+			pe.Close()
+			if backup, err = backupOriginal(path); err != nil {
+				return err
+			}
+			fmt.Printf("moved original %s -> %s\n", path, backup)
+		}
+		if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+			return fmt.Errorf("failed to create output directory: %v", err)
+		}
 		if err := os.WriteFile(outPath, data, 0644); err != nil {
+			if inPlace {
+				undoBackup(path, backup)
+			}
 			return fmt.Errorf("failed to write patched file: %v", err)
 		}
+		patchedOutputs[path] = outPath
 		fmt.Printf("successfully patched %s -> %s\n", path, outPath)
 
 		// Copy progwrp DLLs that are imported by the patched file
@@ -539,35 +771,89 @@ func patchFile(path, arch string, debug bool) error {
 			for k, v := range mapping {
 				fmt.Printf("  key: '%s' (len=%d), value: '%s' (len=%d)\n", k, len(k), v, len(v))
 			}
+			for _, p := range mappingPatterns {
+				fmt.Printf("  pattern: '%s', value: '%s'\n", p.Pattern, p.Replacement)
+			}
 		}
 		fmt.Printf("Copying progwrp DLLs: ")
 		for _, dll := range progwrpDlls {
 			if debug {
 				fmt.Printf("%s ", dll)
 			}
-			if err := copyBlob(arch, dll, filepath.Dir(outPath)); err != nil {
+			if err := copyBlob(arch, dll, blobDir(path, outPath)); err != nil {
 				fmt.Printf("\nwarning: failed to copy blob %s for %s: %v\n", dll, arch, err)
 			} else {
-				fmt.Printf("\ndeployed %s (%s) to %s\n", dll, arch, filepath.Dir(outPath))
+				fmt.Printf("\ndeployed %s (%s) to %s\n", dll, arch, blobDir(path, outPath))
 			}
 		}
 
-		// Patch PE Optional Header for XP compatibility - done separately to avoid file locking
-		if err := patchVersionFields(outPath, debug); err != nil {
+		// Patch PE Optional Header for the target OS - done separately to avoid file locking
+		if err := patchVersionFields(outPath, target, debug); err != nil {
 			fmt.Printf("warning: failed to patch version fields: %v\n", err)
 		}
+
+		if err := applyFixups(outPath, target, debug); err != nil {
+			fmt.Printf("warning: failed to apply fixups: %v\n", err)
+		}
+
+		// The checksum covers the whole file, so it is updated last
+		if err := updateChecksum(outPath, debug); err != nil {
+			fmt.Printf("warning: failed to update checksum: %v\n", err)
+		}
+
+		if err := writeUndoRecord(path, outPath, original, descs); err != nil {
+			fmt.Printf("warning: failed to write undo record: %v\n", err)
+		}
 	} else {
 		fmt.Printf("no imports to patch in %s\n", path)
 	}
 	return nil
 }
 
+// Commands selected by the first command line argument, anything else patches
+var commands = map[string]func(args []string) error{
+	"simulate":   runSimulate,
+	"exportdb":   runExportDB,
+	"mapping":    runMapping,
+	"restore":    runRestore,
+	"unpatch":    runUnpatch,
+	"provenance": runProvenance,
+}
+
 func main() {
-	iniPath := flag.String("ini", "progwrp.ini", "path to ini file mapping DLLs")
+	// Setup base blobs directory next to executable
+	exePath, _ := os.Executable()
+	blobsBaseDir = filepath.Join(filepath.Dir(exePath), "blobs")
+
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	iniPath := flag.String("ini", "", "ini file layered over the built-in mapping and the standard locations")
 	repo := flag.String("repo", "", "GitHub repo for blob releases (owner/repo)")
 	input := flag.String("i", ".", "file or directory to patch")
 	recurse := flag.Bool("r", false, "recurse into directories")
 	debug := flag.Bool("debug", false, "enable debug output")
+	flag.BoolVar(&checkOnly, "check", false, "only report imported functions missing from the progwrp blobs, do not patch")
+	flag.BoolVar(&minimalRedirect, "minimal", false, "only redirect DLLs that import a function missing on the target, leaving the rest untouched")
+	flag.BoolVar(&splitImports, "split", false, "only redirect the functions missing on the target, keeping native ones on the original DLL")
+	flag.StringVar(&targetName, "target", "", "target OS profile: "+targetNames()+" (default xp for x86, xp64 for x86_64)")
+	flag.BoolVar(&zeroChecksum, "zero-checksum", false, "zero the PE checksum of patched files instead of recomputing it")
+	flag.StringVar(&signedPolicy, "signed", "strip", "what to do with signed inputs: strip the signature, keep it or refuse to patch")
+	noFixups := flag.String("no-fixup", "", "comma separated loader fixups to skip: loadconfig, cfg, highentropyva, tls")
+	flag.BoolVar(&linkPatched, "link-patched", false, "make patched binaries import the _patched names of the application DLLs patched next to them")
+	flag.StringVar(&outputDir, "o", "", "write patched binaries under their original names to this directory, mirroring the input layout, instead of next to the input")
+	flag.BoolVar(&copyUnpatched, "copy-unpatched", false, "with -o, also copy the input files that were not patched, so the output is a complete application")
+	flag.BoolVar(&inPlace, "inplace", false, "write patched binaries under their own name, keeping each original as name.orig (see the restore command)")
+	flag.StringVar(&backupDir, "backup-dir", "", "with -inplace, move the originals to this directory, mirroring the input layout, instead of name.orig")
+	journalPath := flag.String("journal", "", "with -inplace, journal of the changes for the restore command (default "+journalFileName+" in the input directory)")
+	dbPath := flag.String("db", "", "export database of the target system (see the exportdb command)")
 	flag.Parse()
 
 	// Check if running on Windows
@@ -583,74 +869,75 @@ func main() {
 		*repo = "matu6968/progwrp-patcher"
 	}
 
-	// Setup base blobs directory next to executable
-	exePath, _ := os.Executable()
-	blobsBaseDir = filepath.Join(filepath.Dir(exePath), "blobs")
-
-	if err := parseIni(*iniPath); err != nil {
+	if _, err := loadMapping(*iniPath); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 
-	// Check if any .exe/.dll files were found before processing
-	foundFiles := false
-	filepath.Walk(*input, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
-			if info.IsDir() && path != *input && !*recurse {
-				return filepath.SkipDir
-			}
-			return nil
-		}
-		ext := strings.ToLower(filepath.Ext(path))
-		if ext == ".exe" || ext == ".dll" {
-			foundFiles = true
+	if targetName != "" {
+		if _, ok := findTarget(targetName); !ok {
+			fmt.Fprintf(os.Stderr, "Error: unknown target %q (available: %s)\n", targetName, targetNames())
+			os.Exit(1)
 		}
-		return nil
-	})
+	}
 
-	if !foundFiles {
-		fmt.Fprintf(os.Stderr, "Error: No .exe or .dll files found in %s\n", *input)
+	if signedPolicy != "strip" && signedPolicy != "keep" && signedPolicy != "refuse" {
+		fmt.Fprintf(os.Stderr, "Error: -signed must be strip, keep or refuse\n")
 		os.Exit(1)
 	}
 
-	// Walk and patch
-	filepath.Walk(*input, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
-			if info.IsDir() && path != *input && !*recurse {
-				return filepath.SkipDir
-			}
-			return nil
-		}
-		ext := strings.ToLower(filepath.Ext(path))
-		if ext != ".exe" && ext != ".dll" {
-			return nil
-		}
-
-		// Skip progwrp replacement DLLs
-		if isProgwrpFile(path) {
-			fmt.Printf("skipping progwrp file: %s\n", path)
-			return nil
-		}
+	if err := parseFixupList(*noFixups); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
 
-		arch, err := detectArch(path)
+	if *dbPath != "" {
+		db, err := loadExportDatabase(*dbPath)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "arch detect failed for %s: %v\n", path, err)
-			return nil
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
 		}
+		targetExports = db
+	}
 
-		// Ensure blobs for this arch are present
-		archDir := filepath.Join(blobsBaseDir, arch)
-		if info, err := os.Stat(archDir); err != nil || !info.IsDir() {
-			fmt.Printf("fetching %s blobs from GitHub (%s)...\n", arch, *repo)
-			if err := fetchBlobs(*repo, arch); err != nil {
-				fmt.Fprintf(os.Stderr, "error fetching %s blobs: %v\n", arch, err)
-				return nil
-			}
+	if inPlace && outputDir != "" {
+		fmt.Fprintf(os.Stderr, "Error: -inplace and -o cannot be combined\n")
+		os.Exit(1)
+	}
+	if backupDir != "" && !inPlace {
+		fmt.Fprintf(os.Stderr, "Error: -backup-dir requires -inplace\n")
+		os.Exit(1)
+	}
+	if err := setInputRoot(*input); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if outputDir != "" {
+		if err := checkOutputTree(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
 		}
-
-		if err := patchFile(path, arch, *debug); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to patch %s: %v\n", path, err)
+	}
+	if inPlace && !checkOnly {
+		if *journalPath == "" {
+			*journalPath = filepath.Join(inputRoot, journalFileName)
 		}
-		return nil
-	})
+		var err error
+		if journal, err = openJournal(*journalPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Collect the .exe/.dll files before processing, and the other files for -copy-unpatched
+	files, others := collectFiles(*input, *recurse)
+	if len(files) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: No .exe or .dll files found in %s\n", *input)
+		os.Exit(1)
+	}
+
+	patchFiles(files, *repo, *debug)
+	if outputDir != "" && copyUnpatched && !checkOnly {
+		copyUnpatchedFiles(append(files, others...))
+	}
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseIniConditions(t *testing.T) {
+	newTestDir(t)
+	ini := `; comment
+[kernel32.dll]
+ReplacementName=pwrp_k32.dll
+Arch=x86
+Targets=xp, 2003
+[ktmw32.dll]
+ReplacementName=p_ktmw32.dll
+Enabled=false
+Note=complete on Vista
+[api-ms-win-core-*]
+ReplacementName=pwrp_k32.dll
+Functions=InitOnceExecuteOnce, GetTickCount64
+`
+	if err := parseIni("test.ini", strings.NewReader(ini)); err != nil {
+		t.Fatal(err)
+	}
+	c := mappingConditions["kernel32.dll"]
+	if c == nil || !reflect.DeepEqual(c.Archs, []string{"x86"}) || !reflect.DeepEqual(c.Targets, []string{"xp", "2003"}) || !c.Enabled {
+		t.Errorf("kernel32.dll conditions = %+v", c)
+	}
+	if c := mappingConditions["ktmw32.dll"]; c == nil || c.Enabled || c.Note != "complete on Vista" {
+		t.Errorf("ktmw32.dll conditions = %+v", c)
+	}
+	if !reflect.DeepEqual(sectionSources["ktmw32.dll"], []string{"test.ini:6"}) {
+		t.Errorf("ktmw32.dll sources = %v", sectionSources["ktmw32.dll"])
+	}
+	if want := map[string]bool{"InitOnceExecuteOnce": true, "GetTickCount64": true}; !reflect.DeepEqual(splitFunctions["api-ms-win-core-*"], want) {
+		t.Errorf("functions = %v", splitFunctions["api-ms-win-core-*"])
+	}
+
+	targetArch, targetProfileName = "x86_64", "xp64"
+	if applies, reason := sectionApplies("kernel32.dll"); applies || reason != "only for x86" {
+		t.Errorf("kernel32.dll for x86_64: %v, %q", applies, reason)
+	}
+	targetArch, targetProfileName = "x86", "vista"
+	if applies, reason := sectionApplies("kernel32.dll"); applies || reason != "only for targets xp, 2003" {
+		t.Errorf("kernel32.dll for vista: %v, %q", applies, reason)
+	}
+	targetArch, targetProfileName = "x86", "xp"
+	if applies, _ := sectionApplies("kernel32.dll"); !applies {
+		t.Errorf("kernel32.dll does not apply to x86 xp")
+	}
+	if applies, reason := sectionApplies("ktmw32.dll"); applies || reason != "disabled" {
+		t.Errorf("ktmw32.dll: %v, %q", applies, reason)
+	}
+}
+
+func TestParseIniErrors(t *testing.T) {
+	newTestDir(t)
+	ini := `[kernel32.dll]
+ReplacementName=pwrp_k32.dll
+Arch=arm64
+not a key value line
+[user32.dll
+Targets=win2k
+[shell32.dll]
+Enabled=maybe
+ReplacementName=
+`
+	err := parseIni("bad.ini", strings.NewReader(ini))
+	if err == nil {
+		t.Fatal("parseIni accepted a malformed ini")
+	}
+	for _, want := range []string{
+		`bad.ini:3: unknown architecture "arm64"`,
+		`bad.ini:4: expected key=value or [section], got "not a key value line"`,
+		`bad.ini:5: malformed section header "[user32.dll"`,
+		`bad.ini:6: key "Targets" outside of a section`,
+		`bad.ini:8: value of Enabled must be true or false, got "maybe"`,
+		`bad.ini:9: empty ReplacementName in [shell32.dll]`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not report %q:\n%v", want, err)
+		}
+	}
+}
+
+func TestParseIniWarnsAboutUnknownKeys(t *testing.T) {
+	newTestDir(t)
+	ini := `[kernel32.dll]
+ReplacementName=pwrp_k32.dll
+Comment=added by another tool
+`
+	var err error
+	out := captureOutput(t, func() { err = parseIni("other.ini", strings.NewReader(ini)) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `warning: other.ini:3: unknown key "Comment" in [kernel32.dll], ignoring it`; !strings.Contains(out, want) {
+		t.Errorf("output %q does not contain %q", out, want)
+	}
+	if mapping["kernel32.dll"] != "pwrp_k32.dll" {
+		t.Errorf("mapping = %v", mapping)
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// mappingPattern is an ini section whose name is a glob pattern, such as [api-ms-win-core-synch-*]
+type mappingPattern struct {
+	Pattern     string // lowercase
+	Replacement string
+}
+
+// Sections with glob patterns in their name, in the order of the ini file
+var mappingPatterns []mappingPattern
+
+// mappingCondition limits a section to some architectures or targets, or turns it off
+type mappingCondition struct {
+	Archs   []string // empty for every architecture
+	Targets []string // profile names, empty for every target
+	Enabled bool
+	Note    string
+}
+
+// Conditions of the sections that have Arch=, Targets=, Enabled= or Note= keys, by lowercase section name
+var mappingConditions = make(map[string]*mappingCondition)
+
+// sectionCondition returns the conditions of a section, adding them on first use
+func sectionCondition(section string) *mappingCondition {
+	c, ok := mappingConditions[section]
+	if !ok {
+		c = &mappingCondition{Enabled: true}
+		mappingConditions[section] = c
+	}
+	return c
+}
+
+// splitList splits a comma separated ini value, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// set parses one condition key of the ini
+func (c *mappingCondition) set(key, value string) error {
+	switch key {
+	case "arch":
+		c.Archs = nil
+		for _, arch := range splitList(value) {
+			arch = strings.ToLower(arch)
+			if arch != "x86" && arch != "x86_64" {
+				return fmt.Errorf("unknown architecture %q (available: x86, x86_64)", arch)
+			}
+			c.Archs = append(c.Archs, arch)
+		}
+	case "targets":
+		c.Targets = nil
+		for _, name := range splitList(value) {
+			profile, ok := findTarget(name)
+			if !ok {
+				return fmt.Errorf("unknown target %q (available: %s)", name, targetNames())
+			}
+			c.Targets = append(c.Targets, profile.Name)
+		}
+	case "enabled":
+		switch strings.ToLower(value) {
+		case "1", "true", "yes", "on":
+			c.Enabled = true
+		case "0", "false", "no", "off":
+			c.Enabled = false
+		default:
+			return fmt.Errorf("value of Enabled must be true or false, got %q", value)
+		}
+	case "note":
+		c.Note = value
+	}
+	return nil
+}
+
+// applies reports whether the section is used for the binary being patched, with the reason when it is not.
+// An unset architecture or target (as in mapping explain without -arch) matches every section.
+func (c *mappingCondition) applies() (bool, string) {
+	if !c.Enabled {
+		return false, "disabled"
+	}
+	if targetArch != "" && len(c.Archs) > 0 && !containsFold(c.Archs, targetArch) {
+		return false, "only for " + strings.Join(c.Archs, ", ")
+	}
+	if targetProfileName != "" && len(c.Targets) > 0 && !containsFold(c.Targets, targetProfileName) {
+		return false, "only for targets " + strings.Join(c.Targets, ", ")
+	}
+	return true, ""
+}
+
+// containsFold reports whether a list holds a string, ignoring case
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// sectionApplies checks the conditions of a section, sections without any always apply
+func sectionApplies(section string) (bool, string) {
+	if c, ok := mappingConditions[section]; ok {
+		return c.applies()
+	}
+	return true, ""
+}
+
+// isPattern reports whether a section name is a glob pattern rather than a DLL name
+func isPattern(section string) bool {
+	return strings.ContainsAny(section, "*?[")
+}
+
+// setPatternReplacement sets the replacement of a pattern section, adding the section on first use
+func setPatternReplacement(pattern, replacement string) {
+	for i := range mappingPatterns {
+		if mappingPatterns[i].Pattern == pattern {
+			mappingPatterns[i].Replacement = replacement
+			return
+		}
+	}
+	mappingPatterns = append(mappingPatterns, mappingPattern{Pattern: pattern, Replacement: replacement})
+}
+
+// patternReplacement returns the replacement of a pattern section
+func patternReplacement(pattern string) (string, bool) {
+	for _, p := range mappingPatterns {
+		if p.Pattern == pattern {
+			return p.Replacement, true
+		}
+	}
+	return "", false
+}
+
+// literalLength counts the characters of a pattern that match only themselves. A bracket
+// expression counts as one character, * and ? as none.
+func literalLength(pattern string) int {
+	n := 0
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*', '?':
+		case '[':
+			if end := strings.IndexByte(pattern[i:], ']'); end > 0 {
+				i += end
+			}
+			n++
+		case '\\':
+			i++
+			n++
+		default:
+			n++
+		}
+	}
+	return n
+}
+
+// matchingPatterns returns the pattern sections matching a DLL name, most specific first:
+// the pattern with the most literal characters wins, ties go to the one listed first.
+// Sections whose conditions do not apply are left out unless all is set.
+func matchingPatterns(dll string, all bool) []mappingPattern {
+	lower := strings.ToLower(dll)
+	var matches []mappingPattern
+	for _, p := range mappingPatterns {
+		if ok, _ := sectionApplies(p.Pattern); !ok && !all {
+			continue
+		}
+		if ok, _ := path.Match(p.Pattern, lower); ok {
+			matches = append(matches, p)
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return literalLength(matches[i].Pattern) > literalLength(matches[j].Pattern)
+	})
+	return matches
+}
+
+// lookupMapping finds the ini section a DLL name maps through. An exact section always takes
+// precedence over patterns, sections whose conditions do not apply are skipped. The section
+// name is returned along with the replacement.
+func lookupMapping(dll string) (string, string, bool) {
+	if dll == "" {
+		return "", "", false
+	}
+	lower := strings.ToLower(dll)
+	if replacement, ok := mapping[lower]; ok {
+		if applies, _ := sectionApplies(lower); applies {
+			return lower, replacement, true
+		}
+	}
+	if matches := matchingPatterns(lower, false); len(matches) > 0 {
+		return matches[0].Pattern, matches[0].Replacement, true
+	}
+	return "", "", false
+}
+
+// mappingSection returns the section that applies to a DLL, falling back to the host of an
+// API set contract when the contract itself matches nothing
+func mappingSection(dll string) (string, string, bool) {
+	if section, replacement, ok := lookupMapping(dll); ok {
+		return section, replacement, true
+	}
+	return lookupMapping(apiSetHost(dll))
+}
+
+// explainMapping prints every rule that could apply to a DLL and which one is used
+func explainMapping(dll string) {
+	lower := strings.ToLower(dll)
+	fmt.Printf("mapping for %s:\n", dll)
+
+	names := []string{lower}
+	if host := apiSetHost(dll); host != "" {
+		names = append(names, host)
+	} else if isAPISet(dll) {
+		fmt.Printf("  %s is an unknown API set contract\n", dll)
+	}
+	selected := false
+	for i, name := range names {
+		if i > 0 {
+			fmt.Printf("  API set contract %s is hosted by %s\n", apiSetContract(dll), name)
+		}
+		candidates := 0
+		if replacement, ok := mapping[name]; ok {
+			candidates++
+			fmt.Printf("  exact section [%s] -> %s%s\n", name, replacement, explainSection(name, &selected))
+		}
+		for _, p := range matchingPatterns(name, true) {
+			candidates++
+			fmt.Printf("  pattern section [%s] -> %s%s\n", p.Pattern, p.Replacement, explainSection(p.Pattern, &selected))
+		}
+		if candidates == 0 {
+			fmt.Printf("  no section matches %s\n", name)
+		}
+	}
+
+	if replacement, ok := replacementFor(dll); ok {
+		fmt.Printf("result: %s -> %s on %s\n", dll, replacement, targetVersion)
+	} else if selected {
+		fmt.Printf("result: %s is not redirected, it is complete on %s\n", dll, targetVersion)
+	} else {
+		fmt.Printf("result: %s is not redirected\n", dll)
+	}
+}
+
+// explainSection describes the conditions of a section in explain output and labels the first
+// applying one as selected
+func explainSection(section string, selected *bool) string {
+	var notes []string
+	if c, ok := mappingConditions[section]; ok && c.Note != "" {
+		notes = append(notes, "note: "+c.Note)
+	}
+	if applies, reason := sectionApplies(section); !applies {
+		notes = append(notes, "skipped, "+reason)
+	} else if !*selected {
+		*selected = true
+		notes = append(notes, "selected")
+	}
+	if len(notes) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(notes, "; ") + ")"
+}
+
+// Subcommands of the mapping command
+var mappingCommands = map[string]func(args []string) error{
+	"explain": runMappingExplain,
+	"check":   runMappingCheck,
+	"show":    runMappingShow,
+}
+
+// runMapping implements the mapping command
+func runMapping(args []string) error {
+	if len(args) > 0 {
+		if cmd, ok := mappingCommands[args[0]]; ok {
+			return cmd(args[1:])
+		}
+	}
+	return fmt.Errorf("usage: mapping explain [-ini file] [-target profile] [-arch x86|x86_64] <dll>...\n" +
+		"       mapping check [-ini file] [-blobs blobs_list.txt]\n" +
+		"       mapping show [-ini file] [-effective]")
+}
+
+// runMappingExplain implements mapping explain
+func runMappingExplain(args []string) error {
+	fs := flag.NewFlagSet("mapping explain", flag.ExitOnError)
+	iniPath := fs.String("ini", "", "ini file layered over the built-in mapping and the standard locations")
+	target := fs.String("target", "xp", "target OS profile: "+targetNames())
+	fs.StringVar(&targetArch, "arch", "", "architecture of the binary: x86 or x86_64 (default any)")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return fmt.Errorf("mapping explain requires a DLL name")
+	}
+	profile, ok := findTarget(*target)
+	if !ok {
+		return fmt.Errorf("unknown target %q (available: %s)", *target, targetNames())
+	}
+	targetVersion = profile.Version
+	targetProfileName = profile.Name
+	if _, err := loadMapping(*iniPath); err != nil {
+		return err
+	}
+	for _, dll := range fs.Args() {
+		explainMapping(dll)
+	}
+	return nil
+}
+
+// readBlobList reads the blob names of blobs_list.txt, one per line
+func readBlobList(listPath string) ([]string, error) {
+	data, err := os.ReadFile(listPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob list: %v", err)
+	}
+	var blobs []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			blobs = append(blobs, line)
+		}
+	}
+	return blobs, nil
+}
+
+// checkMappingConsistency compares the enabled sections of the mapping with the shipped blobs.
+// Every blob needs a section redirecting to it and every section has to redirect to a shipped blob.
+func checkMappingConsistency(blobs []string) []string {
+	shipped := make(map[string]bool)
+	for _, blob := range blobs {
+		shipped[strings.ToLower(blob)] = true
+	}
+
+	used := make(map[string]bool)
+	var problems []string
+	check := func(section, replacement string) {
+		if c, ok := mappingConditions[section]; ok && !c.Enabled {
+			return
+		}
+		used[strings.ToLower(replacement)] = true
+		if !shipped[strings.ToLower(replacement)] {
+			problems = append(problems, fmt.Sprintf("[%s] redirects to %s, which is not in the blob list", section, replacement))
+		}
+	}
+	sections := make([]string, 0, len(mapping))
+	for section := range mapping {
+		sections = append(sections, section)
+	}
+	sort.Strings(sections)
+	for _, section := range sections {
+		check(section, mapping[section])
+	}
+	for _, p := range mappingPatterns {
+		check(p.Pattern, p.Replacement)
+	}
+
+	for _, blob := range blobs {
+		if !used[strings.ToLower(blob)] {
+			problems = append(problems, fmt.Sprintf("%s is shipped but no section redirects to it", blob))
+		}
+	}
+	return problems
+}
+
+// runMappingCheck implements mapping check
+func runMappingCheck(args []string) error {
+	fs := flag.NewFlagSet("mapping check", flag.ExitOnError)
+	iniPath := fs.String("ini", "", "ini file layered over the built-in mapping and the standard locations")
+	listPath := fs.String("blobs", "blobs_list.txt", "list of the shipped blobs")
+	fs.Parse(args)
+
+	if _, err := loadMapping(*iniPath); err != nil {
+		return err
+	}
+	blobs, err := readBlobList(*listPath)
+	if err != nil {
+		return err
+	}
+	problems := checkMappingConsistency(blobs)
+	if len(problems) > 0 {
+		return fmt.Errorf("mapping and %s do not match:\n  %s", *listPath, strings.Join(problems, "\n  "))
+	}
+	fmt.Printf("mapping covers every blob in %s (%d blobs)\n", *listPath, len(blobs))
+	return nil
+}
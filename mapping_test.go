@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLiteralLength(t *testing.T) {
+	tests := map[string]int{
+		"kernel32.dll":              12,
+		"api-ms-win-core-*":         16,
+		"api-ms-win-core-?ynch-*":   21,
+		"api-ms-win-core-[s]ynch-*": 22,
+		"api-ms-win-core-[a-z]*":    17,
+		`pwrp\*.dll`:                9,
+	}
+	for pattern, want := range tests {
+		if got := literalLength(pattern); got != want {
+			t.Errorf("literalLength(%q) = %d, want %d", pattern, got, want)
+		}
+	}
+}
+
+func TestLookupMappingPrecedence(t *testing.T) {
+	newTestDir(t)
+	setPatternReplacement("api-ms-win-core-*", "core.dll")
+	setPatternReplacement("api-ms-win-core-?ynch-*", "any.dll")
+	setPatternReplacement("api-ms-win-core-[s]ynch-*", "bracket.dll")
+	setPatternReplacement("api-ms-win-core-path-*", "path.dll")
+	sectionCondition("api-ms-win-core-path-*").Enabled = false
+	mapping["api-ms-win-core-synch-l1-1-0.dll"] = "exact.dll"
+
+	tests := []struct {
+		dll, section, replacement string
+	}{
+		// An exact section beats every pattern
+		{"api-ms-win-core-synch-l1-1-0.dll", "api-ms-win-core-synch-l1-1-0.dll", "exact.dll"},
+		// The bracket counts as a literal, so it wins over the ? listed before it
+		{"api-ms-win-core-synch-l1-2-0.dll", "api-ms-win-core-[s]ynch-*", "bracket.dll"},
+		{"api-ms-win-core-xynch-l1-1-0.dll", "api-ms-win-core-?ynch-*", "any.dll"},
+		// Disabled sections are skipped in favor of less specific ones
+		{"api-ms-win-core-path-l1-1-0.dll", "api-ms-win-core-*", "core.dll"},
+		{"API-MS-WIN-CORE-FILE-L1-1-0.DLL", "api-ms-win-core-*", "core.dll"},
+	}
+	for _, tt := range tests {
+		section, replacement, ok := lookupMapping(tt.dll)
+		if !ok || section != tt.section || replacement != tt.replacement {
+			t.Errorf("lookupMapping(%q) = %q, %q, %v, want %q, %q", tt.dll, section, replacement, ok, tt.section, tt.replacement)
+		}
+	}
+	if _, _, ok := lookupMapping("user32.dll"); ok {
+		t.Errorf("lookupMapping(user32.dll) matched")
+	}
+}
+
+func TestDefaultMappingMatchesBlobList(t *testing.T) {
+	newTestDir(t)
+	if err := parseIni(embeddedIniName, bytes.NewReader(defaultIni)); err != nil {
+		t.Fatal(err)
+	}
+	blobs, err := readBlobList("blobs_list.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems := checkMappingConsistency(blobs); len(problems) > 0 {
+		t.Errorf("default mapping does not match blobs_list.txt:\n%s", strings.Join(problems, "\n"))
+	}
+
+	// Sections without a shipped or verified blob stay visible but disabled
+	for _, section := range []string{"ktmw32.dll", "bcrypt.dll", "propsys.dll", "shlwapi.dll"} {
+		if c := mappingConditions[section]; c == nil || c.Enabled || c.Note == "" {
+			t.Errorf("[%s] conditions = %+v, want disabled with a note", section, c)
+		}
+	}
+}
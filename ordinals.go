@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	pefile "github.com/saferwall/pe"
+)
+
+// ordinalName looks up the name behind an ordinal import in the export list of the original DLL.
+// Ordinals only mean something for one DLL, so a redirected ordinal import has to go by name.
+func ordinalName(dll string, ordinal uint32) (string, error) {
+	if targetExports == nil {
+		return "", fmt.Errorf("no export list to resolve it with (pass -db)")
+	}
+	exports := targetExports.lookup(dll)
+	if exports == nil {
+		return "", fmt.Errorf("%s is not in the export database", dll)
+	}
+	entry := exports.lookup(fmt.Sprintf("#%d", ordinal))
+	if entry == nil {
+		return "", fmt.Errorf("%s does not export ordinal %d", exports.Name, ordinal)
+	}
+	if entry.Name == "" {
+		return "", fmt.Errorf("ordinal %d of %s has no name", ordinal, exports.Name)
+	}
+	return entry.Name, nil
+}
+
+// redirectedFunctionName is the name a function is looked up by once its DLL is redirected
+func redirectedFunctionName(dll string, fn pefile.ImportFunction) string {
+	if fn.ByOrdinal {
+		if name, err := ordinalName(dll, fn.Ordinal); err == nil {
+			return name
+		}
+	}
+	return importFunctionName(fn)
+}
+
+// hasOrdinalImports reports whether a descriptor imports any of the given slots (all when moved is nil) by ordinal
+func hasOrdinalImports(desc importDescriptor, moved map[uint32]bool) bool {
+	for _, fn := range desc.Functions {
+		if fn.ByOrdinal && (moved == nil || moved[fn.ThunkRVA]) {
+			return true
+		}
+	}
+	return false
+}
+
+// importOrdinalsByName rewrites the ordinal imports of a descriptor that is about to be redirected
+// as imports by name, with the hint/name entries placed in the extra section. Only the slots in
+// moved are rewritten when it is set.
+func importOrdinalsByName(data []byte, desc importDescriptor, moved map[uint32]bool, is64 bool, extra *extraSection) error {
+	for _, fn := range desc.Functions {
+		if !fn.ByOrdinal || (moved != nil && !moved[fn.ThunkRVA]) {
+			continue
+		}
+		name, err := ordinalName(desc.Name, fn.Ordinal)
+		if err != nil {
+			return fmt.Errorf("%s imports ordinal %d, which would point at another function of the replacement: %v", desc.Name, fn.Ordinal, err)
+		}
+
+		// IMAGE_IMPORT_BY_NAME: hint, name, padded to an even size
+		entry := make([]byte, 2, len(name)+4)
+		entry = append(append(entry, name...), 0)
+		if len(entry)%2 != 0 {
+			entry = append(entry, 0)
+		}
+		value := uint64(extra.add(entry, 2) + desc.NameBase)
+
+		// The lookup table holds the import, the IAT of a regular import is a copy of it on
+		// disk. The IAT of a delay-load import points at the loading stubs and stays.
+		slots := []uint32{fn.OriginalThunkRVA}
+		if !desc.Delay {
+			slots = append(slots, fn.ThunkRVA)
+		}
+		for _, rva := range slots {
+			if rva == 0 {
+				continue
+			}
+			offset, err := rvaToOffset(data, rva)
+			if err != nil {
+				return fmt.Errorf("thunk of %s ordinal %d: %v", desc.Name, fn.Ordinal, err)
+			}
+			if is64 {
+				binary.LittleEndian.PutUint64(data[offset:], value)
+			} else {
+				binary.LittleEndian.PutUint32(data[offset:], uint32(value))
+			}
+		}
+		fmt.Printf("importing %s ordinal %d by name: %s\n", desc.Name, fn.Ordinal, name)
+	}
+	return nil
+}
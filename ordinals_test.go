@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func ordinalFixture(t *testing.T, is64 bool) string {
+	t.Helper()
+	dir := newTestDir(t)
+	mapping["kernel32.dll"] = "pwrp_k32.dll"
+	writeFixture(t, blobsBaseDir, fixtureArch(is64)+"/pwrp_k32.dll", fxSpec{Is64: is64, Dll: true,
+		Name: "pwrp_k32.dll", Exports: []fxExport{{Name: "Sleep"}, {Name: "SleepEx"}, {Name: "GetTickCount"}}})
+	return writeFixture(t, dir, "app.exe", fxSpec{Is64: is64, Imports: []fxImport{
+		{DLL: "kernel32.dll", Funcs: []string{"#5", "Sleep", "#9"}},
+		{DLL: "user32.dll", Funcs: []string{"#2"}},
+	}})
+}
+
+func TestImportOrdinalsByName(t *testing.T) {
+	for _, is64 := range []bool{false, true} {
+		t.Run(fixtureArch(is64), func(t *testing.T) {
+			app := ordinalFixture(t, is64)
+			targetExports = &exportDatabase{Modules: map[string]*moduleExports{
+				"kernel32.dll": newModuleExports("KERNEL32.dll", []exportEntry{
+					{Name: "GetTickCount", Ordinal: 5},
+					{Name: "Sleep", Ordinal: 7},
+					{Name: "SleepEx", Ordinal: 9},
+				}),
+			}}
+
+			out := patchFixture(t, app)
+			// Ordinals of DLLs that are not redirected keep their meaning
+			want := []string{"pwrp_k32.dll!GetTickCount", "pwrp_k32.dll!Sleep", "pwrp_k32.dll!SleepEx", "user32.dll!#2"}
+			if got := fixtureImports(t, out); !reflect.DeepEqual(got, want) {
+				t.Errorf("imports = %v, want %v", got, want)
+			}
+			if names := sectionNames(t, readFixture(t, out)); strings.Join(names, " ") != ".text .rdata .data .pwrp .pwrpinf" {
+				t.Errorf("sections = %v", names)
+			}
+		})
+	}
+}
+
+func TestRefuseUnresolvableOrdinal(t *testing.T) {
+	app := ordinalFixture(t, false)
+	err := patchFile(app, "x86", false)
+	if err == nil || !strings.Contains(err.Error(), "kernel32.dll imports ordinal 5") {
+		t.Fatalf("patchFile error without -db = %v", err)
+	}
+
+	targetExports = &exportDatabase{Modules: map[string]*moduleExports{
+		"kernel32.dll": newModuleExports("KERNEL32.dll", []exportEntry{{Name: "GetTickCount", Ordinal: 5}, {Ordinal: 9}}),
+	}}
+	err = patchFile(app, "x86", false)
+	if err == nil || !strings.Contains(err.Error(), "ordinal 9 of KERNEL32.dll has no name") {
+		t.Fatalf("patchFile error for a nameless ordinal = %v", err)
+	}
+	if fileExists(patchedPath(app)) {
+		t.Errorf("patched file was written")
+	}
+}
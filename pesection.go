@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Name of the section the patcher appends for data that does not fit in place
+const extraSectionName = ".pwrp"
+
+// IMAGE_SCN_CNT_INITIALIZED_DATA | IMAGE_SCN_MEM_READ
+const extraSectionCharacteristics = 0x40000040
+
+// Data directory indexes used by the patcher
+const (
+	dirExport      = 0
+	dirImport      = 1
+	dirSecurity    = 4
+	dirBoundImport = 11
+	dirIAT         = 12
+	dirDelayImport = 13
+)
+
+// peLayout holds the file offsets of the headers the patcher edits in a raw PE image
+type peLayout struct {
+	fileHeader    uint32 // IMAGE_FILE_HEADER
+	optHeader     uint32 // IMAGE_OPTIONAL_HEADER
+	magic         uint16
+	sectionTable  uint32
+	numSections   int
+	dataDirectory uint32
+	numDataDirs   uint32
+}
+
+// sectionHeader is the part of IMAGE_SECTION_HEADER the patcher needs
+type sectionHeader struct {
+	VirtualSize      uint32
+	VirtualAddress   uint32
+	SizeOfRawData    uint32
+	PointerToRawData uint32
+	Characteristics  uint32
+}
+
+func alignUp(value, alignment uint32) uint32 {
+	if alignment == 0 {
+		return value
+	}
+	return (value + alignment - 1) / alignment * alignment
+}
+
+// parseLayout locates the headers of a raw PE image
+func parseLayout(data []byte) (*peLayout, error) {
+	if len(data) < 0x40 || string(data[:2]) != "MZ" {
+		return nil, fmt.Errorf("not a PE file")
+	}
+	e_lfanew := binary.LittleEndian.Uint32(data[0x3C:0x40])
+	if uint64(e_lfanew)+0x18+2 > uint64(len(data)) || string(data[e_lfanew:e_lfanew+4]) != "PE\x00\x00" {
+		return nil, fmt.Errorf("invalid NT headers offset 0x%x", e_lfanew)
+	}
+	l := &peLayout{
+		fileHeader: e_lfanew + 4,
+		optHeader:  e_lfanew + 0x18,
+	}
+	l.numSections = int(binary.LittleEndian.Uint16(data[l.fileHeader+2:]))
+	optionalHeaderSize := binary.LittleEndian.Uint16(data[l.fileHeader+16:])
+	l.sectionTable = l.optHeader + uint32(optionalHeaderSize)
+	l.magic = binary.LittleEndian.Uint16(data[l.optHeader:])
+
+	var numDirsOffset uint32
+	switch l.magic {
+	case 0x10b: // PE32
+		numDirsOffset = l.optHeader + 92
+		l.dataDirectory = l.optHeader + 96
+	case 0x20b: // PE32+
+		numDirsOffset = l.optHeader + 108
+		l.dataDirectory = l.optHeader + 112
+	default:
+		return nil, fmt.Errorf("unknown PE magic 0x%x", l.magic)
+	}
+	if int(l.sectionTable)+l.numSections*40 > len(data) {
+		return nil, fmt.Errorf("section table is truncated")
+	}
+	l.numDataDirs = binary.LittleEndian.Uint32(data[numDirsOffset:])
+	if l.dataDirectory+l.numDataDirs*8 > l.sectionTable {
+		l.numDataDirs = (l.sectionTable - l.dataDirectory) / 8
+	}
+	return l, nil
+}
+
+// field returns the file offset of an optional header field
+func (l *peLayout) field(offset uint32) uint32 {
+	return l.optHeader + offset
+}
+
+// directory reads a data directory entry, returning zeros for entries the image does not have
+func (l *peLayout) directory(data []byte, index int) (uint32, uint32) {
+	if uint32(index) >= l.numDataDirs {
+		return 0, 0
+	}
+	entry := l.dataDirectory + uint32(index)*8
+	return binary.LittleEndian.Uint32(data[entry:]), binary.LittleEndian.Uint32(data[entry+4:])
+}
+
+// setDirectory writes a data directory entry
+func (l *peLayout) setDirectory(data []byte, index int, rva, size uint32) error {
+	if uint32(index) >= l.numDataDirs {
+		return fmt.Errorf("image has no data directory %d", index)
+	}
+	entry := l.dataDirectory + uint32(index)*8
+	binary.LittleEndian.PutUint32(data[entry:], rva)
+	binary.LittleEndian.PutUint32(data[entry+4:], size)
+	return nil
+}
+
+// section reads the i-th section header
+func (l *peLayout) section(data []byte, i int) sectionHeader {
+	h := data[l.sectionTable+uint32(i)*40:]
+	return sectionHeader{
+		VirtualSize:      binary.LittleEndian.Uint32(h[8:]),
+		VirtualAddress:   binary.LittleEndian.Uint32(h[12:]),
+		SizeOfRawData:    binary.LittleEndian.Uint32(h[16:]),
+		PointerToRawData: binary.LittleEndian.Uint32(h[20:]),
+		Characteristics:  binary.LittleEndian.Uint32(h[36:]),
+	}
+}
+
+// nextSectionRVA returns the virtual address a section appended to the image would get
+func (l *peLayout) nextSectionRVA(data []byte) uint32 {
+	sectionAlignment := binary.LittleEndian.Uint32(data[l.field(32):])
+	next := alignUp(binary.LittleEndian.Uint32(data[l.field(60):]), sectionAlignment)
+	for i := 0; i < l.numSections; i++ {
+		s := l.section(data, i)
+		size := s.VirtualSize
+		if size < s.SizeOfRawData {
+			size = s.SizeOfRawData
+		}
+		if end := alignUp(s.VirtualAddress+size, sectionAlignment); end > next {
+			next = end
+		}
+	}
+	return next
+}
+
+// newSectionHeader finds the file offset for one more section header and the SizeOfHeaders
+// needed to cover it. The header has to fit between the section table and the first section.
+func (l *peLayout) newSectionHeader(data []byte) (uint32, uint32, error) {
+	fileAlignment := binary.LittleEndian.Uint32(data[l.field(36):])
+	sizeOfHeaders := binary.LittleEndian.Uint32(data[l.field(60):])
+
+	header := l.sectionTable + uint32(l.numSections)*40
+	headerLimit := uint32(len(data))
+	for i := 0; i < l.numSections; i++ {
+		s := l.section(data, i)
+		if s.SizeOfRawData != 0 && s.PointerToRawData < headerLimit {
+			headerLimit = s.PointerToRawData
+		}
+		if s.VirtualAddress < headerLimit {
+			headerLimit = s.VirtualAddress
+		}
+	}
+	if header+40 > headerLimit {
+		return 0, 0, fmt.Errorf("no room for another section header before the first section")
+	}
+	if boundRVA, boundSize := l.directory(data, dirBoundImport); boundSize != 0 && boundRVA < header+40 && boundRVA+boundSize > header {
+		return 0, 0, fmt.Errorf("bound import directory occupies the space for another section header")
+	}
+	for _, b := range data[header : header+40] {
+		if b != 0 {
+			return 0, 0, fmt.Errorf("space after the section table is in use")
+		}
+	}
+	if header+40 > sizeOfHeaders {
+		sizeOfHeaders = alignUp(header+40, fileAlignment)
+		if sizeOfHeaders > headerLimit {
+			return 0, 0, fmt.Errorf("no room to grow SizeOfHeaders")
+		}
+	}
+	return header, sizeOfHeaders, nil
+}
+
+// appendSection adds a section holding content after the last section of the image.
+// Anything past the raw data of the sections (the overlay) is moved behind the new section.
+func appendSection(data []byte, name string, content []byte, characteristics uint32) ([]byte, uint32, error) {
+	l, err := parseLayout(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	sectionAlignment := binary.LittleEndian.Uint32(data[l.field(32):])
+	fileAlignment := binary.LittleEndian.Uint32(data[l.field(36):])
+
+	header, sizeOfHeaders, err := l.newSectionHeader(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	binary.LittleEndian.PutUint32(data[l.field(60):], sizeOfHeaders)
+	rawEnd := sizeOfHeaders
+	for i := 0; i < l.numSections; i++ {
+		s := l.section(data, i)
+		if s.SizeOfRawData != 0 && s.PointerToRawData+s.SizeOfRawData > rawEnd {
+			rawEnd = s.PointerToRawData + s.SizeOfRawData
+		}
+	}
+
+	rva := l.nextSectionRVA(data)
+	rawOffset := alignUp(rawEnd, fileAlignment)
+	rawSize := alignUp(uint32(len(content)), fileAlignment)
+	if uint32(len(data)) < rawOffset {
+		// Pad a truncated last section up to the file alignment
+		data = append(data, make([]byte, rawOffset-uint32(len(data)))...)
+	}
+
+	h := data[header : header+40]
+	copy(h[0:8], name)
+	binary.LittleEndian.PutUint32(h[8:], uint32(len(content)))
+	binary.LittleEndian.PutUint32(h[12:], rva)
+	binary.LittleEndian.PutUint32(h[16:], rawSize)
+	binary.LittleEndian.PutUint32(h[20:], rawOffset)
+	binary.LittleEndian.PutUint32(h[36:], characteristics)
+	binary.LittleEndian.PutUint16(data[l.fileHeader+2:], uint16(l.numSections+1))
+	binary.LittleEndian.PutUint32(data[l.field(56):], alignUp(rva+uint32(len(content)), sectionAlignment))
+
+	// File offsets that point into the overlay move along with it
+	if certOffset, certSize := l.directory(data, dirSecurity); certSize != 0 && certOffset >= rawOffset {
+		l.setDirectory(data, dirSecurity, certOffset+rawSize, certSize)
+	}
+	if symbols := binary.LittleEndian.Uint32(data[l.fileHeader+8:]); symbols != 0 && symbols >= rawOffset {
+		binary.LittleEndian.PutUint32(data[l.fileHeader+8:], symbols+rawSize)
+	}
+
+	raw := make([]byte, rawSize)
+	copy(raw, content)
+	out := make([]byte, 0, len(data)+len(raw))
+	out = append(out, data[:rawOffset]...)
+	out = append(out, raw...)
+	out = append(out, data[rawOffset:]...)
+	return out, rva, nil
+}
+
+// extraSection collects data for a section appended to the image once patching is done.
+// RVAs are handed out up front, so descriptors can point at the data before the section exists.
+type extraSection struct {
+	rva     uint32
+	data    []byte
+	strings map[string]uint32
+}
+
+// newExtraSection prepares a section that will be appended after the current last section
+func newExtraSection(data []byte) (*extraSection, error) {
+	l, err := parseLayout(data)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := l.newSectionHeader(data); err != nil {
+		return nil, err
+	}
+	return &extraSection{rva: l.nextSectionRVA(data), strings: make(map[string]uint32)}, nil
+}
+
+// add places bytes in the section at the given alignment and returns their RVA
+func (s *extraSection) add(b []byte, alignment int) uint32 {
+	for alignment > 1 && len(s.data)%alignment != 0 {
+		s.data = append(s.data, 0)
+	}
+	rva := s.rva + uint32(len(s.data))
+	s.data = append(s.data, b...)
+	return rva
+}
+
+// addString places a null terminated string in the section and returns its RVA, reusing earlier copies
+func (s *extraSection) addString(str string) uint32 {
+	if rva, ok := s.strings[str]; ok {
+		return rva
+	}
+	rva := s.add(append([]byte(str), 0), 1)
+	s.strings[str] = rva
+	return rva
+}
+
+// appendTo adds the collected data to the image as a new section
+func (s *extraSection) appendTo(data []byte) ([]byte, error) {
+	out, rva, err := appendSection(data, extraSectionName, s.data, extraSectionCharacteristics)
+	if err != nil {
+		return nil, err
+	}
+	if rva != s.rva {
+		return nil, fmt.Errorf("section was placed at RVA 0x%x instead of 0x%x", rva, s.rva)
+	}
+	return out, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLongReplacementNameGoesToNewSection(t *testing.T) {
+	for _, is64 := range []bool{false, true} {
+		t.Run(fixtureArch(is64), func(t *testing.T) {
+			dir := newTestDir(t)
+			mapping["kernel32.dll"] = "progwrp_kernel32.dll"
+			writeFixture(t, blobsBaseDir, fixtureArch(is64)+"/progwrp_kernel32.dll", fxSpec{Is64: is64, Dll: true,
+				Name: "progwrp_kernel32.dll", Exports: []fxExport{{Name: "GetTickCount"}}})
+			overlay := []byte("overlay data")
+			app := writeFixture(t, dir, "app.exe", fxSpec{Is64: is64, Overlay: overlay, Imports: []fxImport{
+				{DLL: "kernel32.dll", Funcs: []string{"GetTickCount"}},
+			}})
+
+			out := patchFixture(t, app)
+			want := []string{"progwrp_kernel32.dll!GetTickCount"}
+			if got := fixtureImports(t, out); !reflect.DeepEqual(got, want) {
+				t.Errorf("imports = %v, want %v", got, want)
+			}
+			data := readFixture(t, out)
+			if names := sectionNames(t, data); strings.Join(names, " ") != ".text .rdata .data .pwrp .pwrpinf" {
+				t.Fatalf("sections = %v", names)
+			}
+			if !bytes.HasSuffix(data, overlay) {
+				t.Errorf("overlay was not kept at the end of the file")
+			}
+
+			// The descriptor points into the new section, the old string is left alone
+			l, err := parseLayout(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pwrp := l.section(data, 3)
+			pe, err := parsePE(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pe.Close()
+			desc := importDescriptors(pe)[0]
+			if desc.NameRVA < pwrp.VirtualAddress || desc.NameRVA >= pwrp.VirtualAddress+pwrp.VirtualSize {
+				t.Errorf("name RVA 0x%x is outside .pwrp at 0x%x", desc.NameRVA, pwrp.VirtualAddress)
+			}
+			if !bytes.Contains(data[:pwrp.PointerToRawData], []byte("\x00kernel32.dll\x00")) {
+				t.Errorf("original name string was changed")
+			}
+			if pwrp.Characteristics != extraSectionCharacteristics {
+				t.Errorf(".pwrp characteristics = 0x%x", pwrp.Characteristics)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Version of the patcher, set at build time with -ldflags "-X main.patcherVersion=..."
+var patcherVersion = "dev"
+
+// Name of the section holding the provenance record of a patched binary
+const provenanceSectionName = ".pwrpinf"
+
+// IMAGE_SCN_CNT_INITIALIZED_DATA | IMAGE_SCN_MEM_DISCARDABLE | IMAGE_SCN_MEM_READ, the loader
+// has no use for the record
+const provenanceSectionCharacteristics = 0x42000040
+
+// File in the blobs directory of an arch holding the release tag the blobs were fetched from
+const blobReleaseFile = "release.txt"
+
+// provenance records how a patched binary was produced
+type provenance struct {
+	Patcher       string   `json:"patcher"`
+	MappingSHA256 string   `json:"mapping_sha256"`
+	Blobs         string   `json:"blobs"` // release tag of the progwrp blobs
+	Arch          string   `json:"arch"`
+	Target        string   `json:"target"`
+	TargetVersion string   `json:"target_version"`
+	Modes         []string `json:"modes,omitempty"`
+	Original      string   `json:"original_sha256"`
+}
+
+// releaseTag returns the tag in the path of a GitHub release download URL,
+// /owner/repo/releases/download/<tag>/file
+func releaseTag(urlPath string) string {
+	parts := strings.Split(urlPath, "/")
+	for i := 0; i+2 < len(parts); i++ {
+		if parts[i] == "releases" && parts[i+1] == "download" {
+			return parts[i+2]
+		}
+	}
+	return ""
+}
+
+// redirectedReleaseTag finds the release tag of a download through its redirects. The latest
+// release redirects to the download URL of its tag, which redirects again to the asset host.
+func redirectedReleaseTag(resp *http.Response) string {
+	for req := resp.Request; req != nil; {
+		if tag := releaseTag(req.URL.Path); tag != "" {
+			return tag
+		}
+		if req.Response == nil {
+			break
+		}
+		req = req.Response.Request
+	}
+	return ""
+}
+
+// blobRelease returns the release tag the blobs of an arch were fetched from, or "unknown" for
+// blobs that were put in place by hand
+func blobRelease(arch string) string {
+	data, err := os.ReadFile(filepath.Join(blobsBaseDir, arch, blobReleaseFile))
+	if err != nil || len(bytes.TrimSpace(data)) == 0 {
+		return "unknown"
+	}
+	return string(bytes.TrimSpace(data))
+}
+
+// newProvenance describes the patch of a binary with the current settings
+func newProvenance(original []byte, arch string, target targetProfile) *provenance {
+	p := &provenance{
+		Patcher:       patcherVersion,
+		MappingSHA256: mappingHash,
+		Blobs:         blobRelease(arch),
+		Arch:          arch,
+		Target:        target.Name,
+		TargetVersion: target.Version.String(),
+		Original:      sha256Hex(original),
+	}
+	if minimalRedirect {
+		p.Modes = append(p.Modes, "minimal")
+	}
+	if splitImports {
+		p.Modes = append(p.Modes, "split")
+	}
+	if linkPatched {
+		p.Modes = append(p.Modes, "link-patched")
+	}
+	if inPlace {
+		p.Modes = append(p.Modes, "inplace")
+	}
+	return p
+}
+
+// addProvenance appends the provenance record to an image as its own section
+func addProvenance(data []byte, p *provenance) ([]byte, error) {
+	record, err := json.Marshal(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode provenance: %v", err)
+	}
+	out, _, err := appendSection(data, provenanceSectionName, record, provenanceSectionCharacteristics)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// readProvenance finds the provenance record of a patched binary
+func readProvenance(data []byte) (*provenance, error) {
+	l, err := parseLayout(data)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < l.numSections; i++ {
+		name := data[l.sectionTable+uint32(i)*40:][:8]
+		if string(bytes.TrimRight(name, "\x00")) != provenanceSectionName {
+			continue
+		}
+		s := l.section(data, i)
+		end := uint64(s.PointerToRawData) + uint64(s.VirtualSize)
+		if s.VirtualSize > s.SizeOfRawData || end > uint64(len(data)) {
+			return nil, fmt.Errorf("section %s is outside the file", provenanceSectionName)
+		}
+		p := &provenance{}
+		if err := json.Unmarshal(data[s.PointerToRawData:end], p); err != nil {
+			return nil, fmt.Errorf("failed to decode provenance: %v", err)
+		}
+		return p, nil
+	}
+	return nil, fmt.Errorf("no %s section, the file was not patched or was patched by an older version", provenanceSectionName)
+}
+
+// runProvenance implements the provenance command
+func runProvenance(args []string) error {
+	fs := flag.NewFlagSet("provenance", flag.ExitOnError)
+	input := fs.String("i", "", "patched binary")
+	asJSON := fs.Bool("json", false, "print the record as JSON")
+	fs.Parse(args)
+
+	if *input == "" {
+		return fmt.Errorf("provenance requires -i")
+	}
+	data, err := os.ReadFile(*input)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %v", err)
+	}
+	p, err := readProvenance(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", *input, err)
+	}
+	if *asJSON {
+		out, err := json.MarshalIndent(p, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	modes := "default"
+	if len(p.Modes) > 0 {
+		modes = strings.Join(p.Modes, ", ")
+	}
+	fmt.Printf("%s\n", *input)
+	fmt.Printf("  patcher:          %s\n", p.Patcher)
+	fmt.Printf("  mapping SHA-256:  %s\n", p.MappingSHA256)
+	fmt.Printf("  progwrp blobs:    %s (%s)\n", p.Blobs, p.Arch)
+	fmt.Printf("  target:           %s (%s)\n", p.Target, p.TargetVersion)
+	fmt.Printf("  modes:            %s\n", modes)
+	fmt.Printf("  original SHA-256: %s\n", p.Original)
+	return nil
+}
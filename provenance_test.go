@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReleaseTag(t *testing.T) {
+	tests := map[string]string{
+		"/matu6968/progwrp-patcher/releases/download/v1.4/progwrp_blobs-x86.zip":   "v1.4",
+		"/matu6968/progwrp-patcher/releases/latest/download/progwrp_blobs-x86.zip": "",
+		// Where GitHub finally serves the asset from
+		"/github-production-release-asset-2e65be/512345678/0a1b2c3d-4e5f": "",
+	}
+	for path, want := range tests {
+		if got := releaseTag(path); got != want {
+			t.Errorf("releaseTag(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestRedirectedReleaseTag(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/o/r/releases/latest/download/progwrp_blobs-x86.zip", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/o/r/releases/download/v2.0/progwrp_blobs-x86.zip", http.StatusFound)
+	})
+	mux.HandleFunc("/o/r/releases/download/v2.0/progwrp_blobs-x86.zip", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/github-production-release-asset-2e65be/512345678/0a1b2c3d?X-Amz-Signature=1", http.StatusFound)
+	})
+	mux.HandleFunc("/github-production-release-asset-2e65be/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("PK"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/o/r/releases/latest/download/progwrp_blobs-x86.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if tag := releaseTag(resp.Request.URL.Path); tag != "" {
+		t.Fatalf("final request already carries tag %q", tag)
+	}
+	if tag := redirectedReleaseTag(resp); tag != "v2.0" {
+		t.Errorf("redirectedReleaseTag = %q, want v2.0", tag)
+	}
+}
+
+func TestProvenanceRecord(t *testing.T) {
+	dir := newTestDir(t)
+	mapping["kernel32.dll"] = "pwrp_k32.dll"
+	splitImports = true
+	mappingHash = "0123abcd"
+	writeFixture(t, blobsBaseDir, "x86_64/pwrp_k32.dll", fxSpec{Is64: true, Dll: true, Name: "pwrp_k32.dll",
+		Exports: []fxExport{{Name: "GetTickCount64"}}})
+	if err := os.WriteFile(filepath.Join(blobsBaseDir, "x86_64", blobReleaseFile), []byte("v2.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	app := writeFixture(t, dir, "app.exe", fxSpec{Is64: true, Imports: []fxImport{
+		{DLL: "kernel32.dll", Funcs: []string{"GetTickCount64"}},
+	}})
+	original := readFixture(t, app)
+
+	p, err := readProvenance(readFixture(t, patchFixture(t, app)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Patcher != patcherVersion || p.MappingSHA256 != "0123abcd" || p.Blobs != "v2.0" || p.Arch != "x86_64" || p.Target != "xp64" ||
+		p.Original != sha256Hex(original) || len(p.Modes) != 1 || p.Modes[0] != "split" {
+		t.Errorf("provenance = %+v", p)
+	}
+}
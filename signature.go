@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+
+	pefile "github.com/saferwall/pe"
+)
+
+// What to do with the Authenticode signature of a signed input: strip, keep or refuse
+var signedPolicy = "strip"
+
+// checkSignature logs who signed a binary and applies the refuse policy.
+// It returns whether the binary carries a certificate table.
+func checkSignature(pe *pefile.File, data []byte, path string) (bool, error) {
+	l, err := parseLayout(data)
+	if err != nil {
+		return false, err
+	}
+	if _, size := l.directory(data, dirSecurity); size == 0 {
+		return false, nil
+	}
+
+	if len(pe.Certificates.Certificates) == 0 {
+		fmt.Printf("%s has a certificate table that could not be parsed\n", path)
+	}
+	for _, cert := range pe.Certificates.Certificates {
+		fmt.Printf("%s is signed by %s (issuer %s)\n", path, cert.Info.Subject, cert.Info.Issuer)
+	}
+
+	switch signedPolicy {
+	case "refuse":
+		return true, fmt.Errorf("refusing to patch signed file (use -signed strip or -signed keep)")
+	case "keep":
+		fmt.Printf("warning: keeping the signature, it will not be valid for the patched file\n")
+	}
+	return true, nil
+}
+
+// stripSignature zeroes the security directory and removes the certificate table it points at.
+// The table is cut off when it ends the file and cleared in place when other data follows it.
+func stripSignature(data []byte) ([]byte, error) {
+	l, err := parseLayout(data)
+	if err != nil {
+		return nil, err
+	}
+	offset, size := l.directory(data, dirSecurity)
+	if size == 0 {
+		return data, nil
+	}
+	if err := l.setDirectory(data, dirSecurity, 0, 0); err != nil {
+		return nil, err
+	}
+	end := uint64(offset) + uint64(size)
+	if end > uint64(len(data)) {
+		return nil, fmt.Errorf("certificate table at 0x%x (%d bytes) is outside the file", offset, size)
+	}
+
+	// Entries are padded to 8 bytes, so the file may end a little after the table
+	if uint64(len(data))-end < 8 {
+		fmt.Printf("removed certificate table (%d bytes)\n", len(data)-int(offset))
+		return data[:offset], nil
+	}
+	for i := offset; uint64(i) < end; i++ {
+		data[i] = 0
+	}
+	fmt.Printf("cleared certificate table (%d bytes) followed by other data\n", size)
+	return data, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func signedFixture(t *testing.T, is64 bool) (string, []byte) {
+	t.Helper()
+	dir := newTestDir(t)
+	mapping["kernel32.dll"] = "pwrp_k32.dll"
+	writeFixture(t, blobsBaseDir, fixtureArch(is64)+"/pwrp_k32.dll", fxSpec{Is64: is64, Dll: true,
+		Name: "pwrp_k32.dll", Exports: []fxExport{{Name: "GetTickCount"}}})
+	overlay := []byte("installer payload")
+	app := writeFixture(t, dir, "app.exe", fxSpec{Is64: is64, Overlay: overlay, Signature: []byte("not really PKCS#7"),
+		Imports: []fxImport{{DLL: "kernel32.dll", Funcs: []string{"GetTickCount"}}}})
+	return app, overlay
+}
+
+func TestStripSignature(t *testing.T) {
+	for _, is64 := range []bool{false, true} {
+		t.Run(fixtureArch(is64), func(t *testing.T) {
+			app, overlay := signedFixture(t, is64)
+			data := readFixture(t, patchFixture(t, app))
+			l, err := parseLayout(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if offset, size := l.directory(data, dirSecurity); offset != 0 || size != 0 {
+				t.Errorf("security directory = 0x%x, %d", offset, size)
+			}
+			if !bytes.HasSuffix(data, overlay) {
+				t.Errorf("certificate table was not cut off after the overlay")
+			}
+		})
+	}
+}
+
+func TestStripSignatureClearsTableInPlace(t *testing.T) {
+	data := buildPE(fxSpec{Signature: []byte("signature")})
+	data = append(data, []byte("data appended after signing")...)
+	l, err := parseLayout(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset, size := l.directory(data, dirSecurity)
+	out, err := stripSignature(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != len(data) {
+		t.Errorf("file size changed from %d to %d", len(data), len(out))
+	}
+	if !bytes.Equal(out[offset:offset+size], make([]byte, size)) {
+		t.Errorf("certificate table was not cleared")
+	}
+}
+
+func TestRefuseSignedFile(t *testing.T) {
+	app, _ := signedFixture(t, false)
+	signedPolicy = "refuse"
+	err := patchFile(app, "x86", false)
+	if err == nil || !strings.Contains(err.Error(), "refusing to patch signed file") {
+		t.Fatalf("patchFile error = %v", err)
+	}
+	if fileExists(patchedPath(app)) {
+		t.Errorf("patched file was written")
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DLLs the XP loader always maps from the system directory (KnownDLLs), ignoring the app directory
+var xpKnownDlls = map[string]bool{
+	"ntdll.dll": true, "kernel32.dll": true, "advapi32.dll": true, "comdlg32.dll": true,
+	"gdi32.dll": true, "imagehlp.dll": true, "lz32.dll": true, "ole32.dll": true,
+	"oleaut32.dll": true, "olecli32.dll": true, "olecnv32.dll": true, "olesvr32.dll": true,
+	"olethk32.dll": true, "rpcrt4.dll": true, "shell32.dll": true, "url.dll": true,
+	"urlmon.dll": true, "user32.dll": true, "version.dll": true, "wininet.dll": true,
+	"wldap32.dll": true,
+}
+
+// simModule is a DLL (or the main binary) mapped by the simulated loader
+type simModule struct {
+	name    string
+	path    string
+	origin  string // where the loader found it: app, system or database
+	exports *moduleExports
+}
+
+// unresolvedImport is an import the simulated loader could not bind
+type unresolvedImport struct {
+	Importer string
+	DLL      string
+	Function string
+	Reason   string
+}
+
+// loaderSim resolves imports the way the Windows XP loader does
+type loaderSim struct {
+	arch    string
+	appDir  string
+	blobDir string
+	sysDir  string
+	db      *exportDatabase // used instead of sysDir when set
+	debug   bool
+
+	modules    map[string]*simModule // lowercase DLL name -> module, nil when not found
+	order      []*simModule
+	pending    []*simModule
+	unresolved []unresolvedImport
+}
+
+func newLoaderSim(arch, appDir, sysDir string, db *exportDatabase, debug bool) *loaderSim {
+	return &loaderSim{
+		arch:    arch,
+		appDir:  appDir,
+		blobDir: filepath.Join(blobsBaseDir, arch),
+		sysDir:  sysDir,
+		db:      db,
+		debug:   debug,
+		modules: make(map[string]*simModule),
+	}
+}
+
+// findFile looks up a file in a directory ignoring case, as Windows does
+func findFile(dir, name string) string {
+	if dir == "" {
+		return ""
+	}
+	p := filepath.Join(dir, name)
+	if _, err := os.Stat(p); err == nil {
+		return p
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.EqualFold(entry.Name(), name) {
+			return filepath.Join(dir, entry.Name())
+		}
+	}
+	return ""
+}
+
+// locate applies the XP search order: KnownDLLs, app directory, then the system directory.
+// The blobs directory is not searched, a blob missing from the app directory is what the
+// simulation has to catch.
+func (s *loaderSim) locate(name string) (string, string) {
+	lower := strings.ToLower(name)
+	if !xpKnownDlls[lower] {
+		if p := findFile(s.appDir, name); p != "" {
+			return p, "app"
+		}
+	}
+	if p := findFile(s.sysDir, name); p != "" {
+		return p, "system"
+	}
+	return "", ""
+}
+
+// load maps a DLL by name, queueing its imports for resolution the first time it is seen
+func (s *loaderSim) load(name string) (*simModule, string) {
+	lower := strings.ToLower(name)
+	if mod, ok := s.modules[lower]; ok {
+		if mod == nil {
+			return nil, fmt.Sprintf("%s could not be loaded", name)
+		}
+		return mod, ""
+	}
+
+	path, origin := s.locate(name)
+	if path == "" {
+		if s.db != nil {
+			if exports := s.db.lookup(name); exports != nil {
+				mod := &simModule{name: exports.Name, origin: "database", exports: exports}
+				s.modules[lower] = mod
+				s.order = append(s.order, mod)
+				return mod, ""
+			}
+		}
+		s.modules[lower] = nil
+		if findFile(s.blobDir, name) != "" {
+			return nil, fmt.Sprintf("%s not found (it is in the blobs directory, deploy it next to the binary)", name)
+		}
+		return nil, fmt.Sprintf("%s not found", name)
+	}
+	mod, reason := s.open(path, origin)
+	s.modules[lower] = mod
+	return mod, reason
+}
+
+// open maps a module from disk after checking it matches the simulated architecture
+func (s *loaderSim) open(path, origin string) (*simModule, string) {
+	arch, err := detectArch(path)
+	if err != nil {
+		return nil, fmt.Sprintf("%s is not a valid image: %v", filepath.Base(path), err)
+	}
+	if arch != s.arch {
+		return nil, fmt.Sprintf("%s is %s, not %s", filepath.Base(path), arch, s.arch)
+	}
+	exports, err := readModuleExports(path)
+	if err != nil {
+		return nil, fmt.Sprintf("%s: %v", filepath.Base(path), err)
+	}
+	mod := &simModule{name: filepath.Base(path), path: path, origin: origin, exports: exports}
+	s.order = append(s.order, mod)
+	s.pending = append(s.pending, mod)
+	if s.debug {
+		fmt.Printf("[DEBUG] loaded %s from %s (%s)\n", mod.name, path, origin)
+	}
+	return mod, ""
+}
+
+// resolve binds a function in a module, following forwarders into other modules
+func (s *loaderSim) resolve(mod *simModule, function string, depth int) string {
+	if depth > maxForwarderDepth {
+		return "forwarder chain too deep"
+	}
+	entry := mod.exports.lookup(function)
+	if entry == nil {
+		return fmt.Sprintf("not exported by %s", mod.name)
+	}
+	if entry.Forwarder == "" {
+		return ""
+	}
+	target, targetFunction, ok := splitForwarder(entry.Forwarder)
+	if !ok {
+		return fmt.Sprintf("malformed forwarder %q in %s", entry.Forwarder, mod.name)
+	}
+	targetMod, reason := s.load(target)
+	if targetMod == nil {
+		return fmt.Sprintf("forwarded to %s: %s", entry.Forwarder, reason)
+	}
+	if reason := s.resolve(targetMod, targetFunction, depth+1); reason != "" {
+		return fmt.Sprintf("forwarded to %s: %s", entry.Forwarder, reason)
+	}
+	return ""
+}
+
+// bindImports resolves the static imports of a mapped module
+func (s *loaderSim) bindImports(mod *simModule) error {
+	if mod.path == "" {
+		// System DLLs from an export database carry no import information
+		return nil
+	}
+	pe, err := parsePE(mod.path)
+	if err != nil {
+		return err
+	}
+	defer pe.Close()
+
+	for _, imp := range pe.Imports {
+		dep, reason := s.load(imp.Name)
+		if dep == nil {
+			s.unresolved = append(s.unresolved, unresolvedImport{
+				Importer: mod.name,
+				DLL:      imp.Name,
+				Reason:   reason,
+			})
+			continue
+		}
+		for _, fn := range imp.Functions {
+			function := importFunctionName(fn)
+			if reason := s.resolve(dep, function, 0); reason != "" {
+				s.unresolved = append(s.unresolved, unresolvedImport{
+					Importer: mod.name,
+					DLL:      imp.Name,
+					Function: function,
+					Reason:   reason,
+				})
+			}
+		}
+	}
+	return nil
+}
+
+// run maps the main binary and binds every module transitively pulled in by it
+func (s *loaderSim) run(binary string) error {
+	mod, reason := s.open(binary, "app")
+	if mod == nil {
+		return fmt.Errorf("cannot load %s: %s", binary, reason)
+	}
+	s.modules[strings.ToLower(mod.name)] = mod
+	// ntdll is mapped into every process before anything else
+	if ntdll, reason := s.load("ntdll.dll"); ntdll == nil {
+		s.unresolved = append(s.unresolved, unresolvedImport{
+			Importer: mod.name,
+			DLL:      "ntdll.dll",
+			Reason:   reason,
+		})
+	}
+
+	for len(s.pending) > 0 {
+		next := s.pending[0]
+		s.pending = s.pending[1:]
+		if err := s.bindImports(next); err != nil {
+			return fmt.Errorf("failed to read imports of %s: %v", next.name, err)
+		}
+	}
+	return nil
+}
+
+// report prints the modules that were mapped and every unresolved import
+func (s *loaderSim) report() {
+	fmt.Printf("loaded modules:\n")
+	for _, mod := range s.order {
+		fmt.Printf("  %-24s %s\n", mod.name, mod.origin)
+	}
+	if len(s.unresolved) == 0 {
+		fmt.Printf("all imports resolved\n")
+		return
+	}
+	fmt.Printf("unresolved imports (%d):\n", len(s.unresolved))
+	for _, u := range s.unresolved {
+		if u.Function == "" {
+			fmt.Printf("  %s: %s: %s\n", u.Importer, u.DLL, u.Reason)
+		} else {
+			fmt.Printf("  %s: %s!%s: %s\n", u.Importer, u.DLL, u.Function, u.Reason)
+		}
+	}
+}
+
+// runSimulate implements the simulate command
+func runSimulate(args []string) error {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	input := fs.String("i", "", "patched binary to load")
+	sysroot := fs.String("sysroot", "", "directory holding the Windows XP system DLLs (system32)")
+	dbPath := fs.String("db", "", "export database written by the exportdb command, instead of -sysroot")
+	appDir := fs.String("app", "", "application directory (defaults to the directory of the binary)")
+	debug := fs.Bool("debug", false, "enable debug output")
+	fs.Parse(args)
+
+	if *input == "" || (*sysroot == "") == (*dbPath == "") {
+		return fmt.Errorf("simulate requires -i and either -sysroot or -db")
+	}
+	if *appDir == "" {
+		*appDir = filepath.Dir(*input)
+	}
+	arch, err := detectArch(*input)
+	if err != nil {
+		return err
+	}
+
+	var db *exportDatabase
+	if *dbPath != "" {
+		if db, err = loadExportDatabase(*dbPath); err != nil {
+			return err
+		}
+		if db.Arch != arch {
+			return fmt.Errorf("export database %s is for %s, not %s", *dbPath, db.Arch, arch)
+		}
+	}
+
+	fmt.Printf("simulating Windows XP loader for %s (%s)\n", *input, arch)
+	sim := newLoaderSim(arch, *appDir, *sysroot, db, *debug)
+	if err := sim.run(*input); err != nil {
+		return err
+	}
+	sim.report()
+	if len(sim.unresolved) > 0 {
+		return fmt.Errorf("%d unresolved imports", len(sim.unresolved))
+	}
+	return nil
+}
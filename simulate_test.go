@@ -0,0 +1,106 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestLoaderSimResolvesLikeXP(t *testing.T) {
+	dir := newTestDir(t)
+	sysDir := filepath.Join(dir, "system32")
+	appDir := filepath.Join(dir, "app")
+
+	writeFixture(t, sysDir, "ntdll.dll", fxSpec{Dll: true, Name: "ntdll.dll",
+		Exports: []fxExport{{Name: "RtlGetVersion"}}})
+	writeFixture(t, sysDir, "kernel32.dll", fxSpec{Dll: true, Name: "kernel32.dll",
+		Exports: []fxExport{
+			{Name: "GetTickCount"},
+			{Name: "GetVersionEx", Forwarder: "ntdll.RtlGetVersion"},
+			{Name: "GetNativeInfo", Forwarder: "ntdll.RtlGetNativeInfo"},
+		}})
+	// KnownDLLs come from the system directory even when the app ships its own copy
+	writeFixture(t, appDir, "kernel32.dll", fxSpec{Dll: true, Name: "kernel32.dll"})
+	blob := fxSpec{Dll: true, Name: "pwrp_k32.dll", Exports: []fxExport{{Name: "GetTickCount64"}}}
+	writeFixture(t, blobsBaseDir, "x86/pwrp_k32.dll", blob)
+	writeFixture(t, appDir, "pwrp_k32.dll", blob)
+	// A blob that was not deployed is not found, even though the patcher has a copy
+	writeFixture(t, blobsBaseDir, "x86/pwrp_u32.dll", fxSpec{Dll: true, Name: "pwrp_u32.dll",
+		Exports: []fxExport{{Name: "GetDpiForWindow"}}})
+	app := writeFixture(t, appDir, "app.exe", fxSpec{Imports: []fxImport{
+		{DLL: "KERNEL32.dll", Funcs: []string{"GetTickCount", "GetVersionEx", "GetNativeInfo", "InitOnceExecuteOnce"}},
+		{DLL: "pwrp_k32.dll", Funcs: []string{"GetTickCount64"}},
+		{DLL: "pwrp_u32.dll", Funcs: []string{"GetDpiForWindow"}},
+		{DLL: "missing.dll", Funcs: []string{"Anything"}},
+	}})
+
+	sim := newLoaderSim("x86", appDir, sysDir, nil, false)
+	if err := sim.run(app); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []unresolvedImport{
+		{Importer: "app.exe", DLL: "KERNEL32.dll", Function: "GetNativeInfo",
+			Reason: "forwarded to ntdll.RtlGetNativeInfo: not exported by ntdll.dll"},
+		{Importer: "app.exe", DLL: "KERNEL32.dll", Function: "InitOnceExecuteOnce",
+			Reason: "not exported by kernel32.dll"},
+		{Importer: "app.exe", DLL: "pwrp_u32.dll",
+			Reason: "pwrp_u32.dll not found (it is in the blobs directory, deploy it next to the binary)"},
+		{Importer: "app.exe", DLL: "missing.dll", Reason: "missing.dll not found"},
+	}
+	if len(sim.unresolved) != len(want) {
+		t.Fatalf("unresolved = %+v, want %+v", sim.unresolved, want)
+	}
+	for i := range want {
+		if sim.unresolved[i] != want[i] {
+			t.Errorf("unresolved[%d] = %+v, want %+v", i, sim.unresolved[i], want[i])
+		}
+	}
+
+	origins := make(map[string]string)
+	for _, mod := range sim.order {
+		origins[mod.name] = mod.origin
+	}
+	for name, origin := range map[string]string{"kernel32.dll": "system", "pwrp_k32.dll": "app", "ntdll.dll": "system"} {
+		if origins[name] != origin {
+			t.Errorf("%s loaded from %q, want %q", name, origins[name], origin)
+		}
+	}
+}
+
+func TestLoaderSimRejectsOtherArch(t *testing.T) {
+	dir := newTestDir(t)
+	sysDir := filepath.Join(dir, "system32")
+	writeFixture(t, sysDir, "ntdll.dll", fxSpec{Dll: true, Name: "ntdll.dll"})
+	writeFixture(t, sysDir, "kernel32.dll", fxSpec{Dll: true, Name: "kernel32.dll", Is64: true,
+		Exports: []fxExport{{Name: "GetTickCount"}}})
+	app := writeFixture(t, dir, "app.exe", fxSpec{Imports: []fxImport{
+		{DLL: "kernel32.dll", Funcs: []string{"GetTickCount"}},
+	}})
+
+	sim := newLoaderSim("x86", dir, sysDir, nil, false)
+	if err := sim.run(app); err != nil {
+		t.Fatal(err)
+	}
+	if len(sim.unresolved) != 1 || sim.unresolved[0].Reason != "kernel32.dll is x86_64, not x86" {
+		t.Fatalf("unresolved = %+v", sim.unresolved)
+	}
+}
+
+func TestLoaderSimReportsMissingNtdll(t *testing.T) {
+	dir := newTestDir(t)
+	sysDir := filepath.Join(dir, "system32")
+	writeFixture(t, sysDir, "kernel32.dll", fxSpec{Dll: true, Name: "kernel32.dll",
+		Exports: []fxExport{{Name: "GetTickCount"}}})
+	app := writeFixture(t, dir, "app.exe", fxSpec{Imports: []fxImport{
+		{DLL: "kernel32.dll", Funcs: []string{"GetTickCount"}},
+	}})
+
+	sim := newLoaderSim("x86", dir, sysDir, nil, false)
+	if err := sim.run(app); err != nil {
+		t.Fatal(err)
+	}
+	want := unresolvedImport{Importer: "app.exe", DLL: "ntdll.dll", Reason: "ntdll.dll not found"}
+	if len(sim.unresolved) != 1 || sim.unresolved[0] != want {
+		t.Fatalf("unresolved = %+v, want %+v", sim.unresolved, want)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Size of IMAGE_IMPORT_DESCRIPTOR
+const importDescriptorSize = 20
+
+// Split import descriptors so only the functions a DLL lacks go to progwrp
+var splitImports bool
+
+// Functions to move to the replacement DLL, per lowercase section name, from the Functions= key of the ini
+var splitFunctions = make(map[string]map[string]bool)
+
+// Export database of the target system, used to tell which functions exist natively
+var targetExports *exportDatabase
+
+// redirectFunction decides whether an imported function moves to the replacement DLL.
+// Without -split everything moves, otherwise the Functions= list of the section the DLL maps
+// through or the exports of the target OS decide.
+func redirectFunction(dll, function string) bool {
+	if !splitImports {
+		return true
+	}
+	if section, _, ok := mappingSection(dll); ok {
+		if functions, ok := splitFunctions[section]; ok {
+			return functions[function]
+		}
+	}
+	return missingOnTarget(dll, function)
+}
+
+// planSplit returns the IAT slots (by thunk RVA) of a descriptor whose functions move to the replacement DLL
+func planSplit(desc importDescriptor) map[uint32]bool {
+	moved := make(map[uint32]bool)
+	for _, fn := range desc.Functions {
+		if redirectFunction(desc.Name, importFunctionName(fn)) {
+			moved[fn.ThunkRVA] = true
+		}
+	}
+	return moved
+}
+
+// readThunk reads one IMAGE_THUNK_DATA entry
+func readThunk(data []byte, offset uint32, is64 bool) uint64 {
+	if is64 {
+		return binary.LittleEndian.Uint64(data[offset:])
+	}
+	return uint64(binary.LittleEndian.Uint32(data[offset:]))
+}
+
+// appendThunk encodes one IMAGE_THUNK_DATA entry
+func appendThunk(b []byte, value uint64, is64 bool) []byte {
+	if is64 {
+		var t [8]byte
+		binary.LittleEndian.PutUint64(t[:], value)
+		return append(b, t[:]...)
+	}
+	var t [4]byte
+	binary.LittleEndian.PutUint32(t[:], uint32(value))
+	return append(b, t[:]...)
+}
+
+// splitDescriptor builds the descriptors replacing one import descriptor. Code calls through
+// the IAT slots, so those stay where they are: each run of consecutive slots going to the same
+// DLL becomes its own descriptor with a fresh lookup table in the extra section.
+func splitDescriptor(data []byte, raw []byte, moved map[uint32]bool, originalName, replacementName uint32, is64 bool, extra *extraSection) ([]byte, error) {
+	originalFirstThunk := binary.LittleEndian.Uint32(raw[0:])
+	firstThunk := binary.LittleEndian.Uint32(raw[16:])
+	lookup := originalFirstThunk
+	if lookup == 0 {
+		// No lookup table, the IAT holds the names until the image is loaded
+		lookup = firstThunk
+	}
+	lookupOffset, err := rvaToOffset(data, lookup)
+	if err != nil {
+		return nil, fmt.Errorf("import lookup table: %v", err)
+	}
+
+	thunkSize := uint32(4)
+	if is64 {
+		thunkSize = 8
+	}
+	var thunks []uint64
+	for offset := lookupOffset; int(offset+thunkSize) <= len(data); offset += thunkSize {
+		value := readThunk(data, offset, is64)
+		if value == 0 {
+			break
+		}
+		thunks = append(thunks, value)
+	}
+
+	var descriptors []byte
+	for start := 0; start < len(thunks); {
+		target := moved[firstThunk+uint32(start)*thunkSize]
+		end := start + 1
+		for end < len(thunks) && moved[firstThunk+uint32(end)*thunkSize] == target {
+			end++
+		}
+
+		var table []byte
+		for _, value := range thunks[start:end] {
+			table = appendThunk(table, value, is64)
+		}
+		table = appendThunk(table, 0, is64)
+		name := originalName
+		if target {
+			name = replacementName
+		}
+
+		var d [importDescriptorSize]byte
+		binary.LittleEndian.PutUint32(d[0:], extra.add(table, int(thunkSize)))
+		binary.LittleEndian.PutUint32(d[12:], name)
+		binary.LittleEndian.PutUint32(d[16:], firstThunk+uint32(start)*thunkSize)
+		descriptors = append(descriptors, d[:]...)
+		start = end
+	}
+	return descriptors, nil
+}
+
+// rebuildImportTable writes a new import directory into the extra section, replacing the split
+// descriptors and copying every other descriptor as it is, then points data directory 1 at it
+func rebuildImportTable(data []byte, tableStart uint32, descs []importDescriptor, splits map[int]map[uint32]bool, replacements map[int]string, extra *extraSection) error {
+	l, err := parseLayout(data)
+	if err != nil {
+		return err
+	}
+	is64 := l.magic == 0x20b
+
+	byOffset := make(map[uint32]int)
+	for i, desc := range descs {
+		if !desc.Delay {
+			byOffset[desc.Offset] = i
+		}
+	}
+
+	var table []byte
+	var zero [importDescriptorSize]byte
+	for offset := tableStart; int(offset+importDescriptorSize) <= len(data); offset += importDescriptorSize {
+		raw := data[offset : offset+importDescriptorSize]
+		if string(raw) == string(zero[:]) {
+			break
+		}
+		i, ok := byOffset[offset]
+		moved := splits[i]
+		if !ok || moved == nil {
+			table = append(table, raw...)
+			continue
+		}
+		split, err := splitDescriptor(data, raw, moved, extra.addString(descs[i].Name), extra.addString(replacements[i]), is64, extra)
+		if err != nil {
+			return fmt.Errorf("failed to split %s: %v", descs[i].Name, err)
+		}
+		table = append(table, split...)
+	}
+	table = append(table, zero[:]...)
+
+	rva := extra.add(table, 4)
+	return l.setDirectory(data, dirImport, rva, uint32(len(table)))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitImportDescriptor(t *testing.T) {
+	for _, is64 := range []bool{false, true} {
+		t.Run(fixtureArch(is64), func(t *testing.T) {
+			dir := newTestDir(t)
+			splitImports = true
+			mapping["kernel32.dll"] = "pwrp_k32.dll"
+			splitFunctions["kernel32.dll"] = map[string]bool{"GetTickCount64": true}
+			writeFixture(t, blobsBaseDir, fixtureArch(is64)+"/pwrp_k32.dll", fxSpec{Is64: is64, Dll: true,
+				Name: "pwrp_k32.dll", Exports: []fxExport{{Name: "GetTickCount64"}}})
+			app := writeFixture(t, dir, "app.exe", fxSpec{Is64: is64, Imports: []fxImport{
+				{DLL: "kernel32.dll", Funcs: []string{"GetTickCount", "GetTickCount64", "Sleep"}},
+			}})
+
+			out := patchFixture(t, app)
+			want := []string{"kernel32.dll!GetTickCount", "pwrp_k32.dll!GetTickCount64", "kernel32.dll!Sleep"}
+			if got := fixtureImports(t, out); !reflect.DeepEqual(got, want) {
+				t.Errorf("imports = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestSplitRefusesPartialDelayLoad(t *testing.T) {
+	dir := newTestDir(t)
+	splitImports = true
+	mapping["kernel32.dll"] = "pwrp_k32.dll"
+	splitFunctions["kernel32.dll"] = map[string]bool{"GetTickCount64": true}
+	writeFixture(t, blobsBaseDir, "x86/pwrp_k32.dll", fxSpec{Dll: true, Name: "pwrp_k32.dll",
+		Exports: []fxExport{{Name: "GetTickCount"}, {Name: "GetTickCount64"}}})
+	app := writeFixture(t, dir, "app.exe", fxSpec{Delay: []fxImport{
+		{DLL: "kernel32.dll", Funcs: []string{"GetTickCount", "GetTickCount64"}},
+	}})
+
+	err := patchFile(app, "x86", false)
+	if err == nil || !strings.Contains(err.Error(), "cannot split delay-load import kernel32.dll") {
+		t.Fatalf("patchFile error = %v", err)
+	}
+	if fileExists(patchedPath(app)) {
+		t.Errorf("patched file was written")
+	}
+
+	// Redirecting every function of the descriptor needs no split
+	splitFunctions["kernel32.dll"]["GetTickCount"] = true
+	out := patchFixture(t, app)
+	want := []string{"delay pwrp_k32.dll!GetTickCount", "delay pwrp_k32.dll!GetTickCount64"}
+	if got := fixtureImports(t, out); !reflect.DeepEqual(got, want) {
+		t.Errorf("imports = %v, want %v", got, want)
+	}
+}
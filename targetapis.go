@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// osVersion is a Windows version as stored in the PE optional header
+type osVersion struct {
+	Major, Minor uint16
+}
+
+func (v osVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// before reports whether v is an older Windows version than o
+func (v osVersion) before(o osVersion) bool {
+	return v.Major < o.Major || (v.Major == o.Major && v.Minor < o.Minor)
+}
+
+var (
+	winXP64 = osVersion{5, 2} // also Server 2003
+	vista   = osVersion{6, 0}
+	win7    = osVersion{6, 1}
+	win8    = osVersion{6, 2}
+	win81   = osVersion{6, 3}
+	win10   = osVersion{10, 0}
+)
+
+// targetProfile is a Windows release binaries can be patched for
+type targetProfile struct {
+	Name    string
+	Title   string
+	Version osVersion
+	Archs   []string // architectures the release exists for
+}
+
+// Profiles selected with -target
+var targetProfiles = []targetProfile{
+	{"xp", "Windows XP", osVersion{5, 1}, []string{"x86"}},
+	{"xp64", "Windows XP x64", winXP64, []string{"x86_64"}},
+	{"2003", "Windows Server 2003", winXP64, []string{"x86", "x86_64"}},
+	{"vista", "Windows Vista", vista, []string{"x86", "x86_64"}},
+}
+
+// Profile name given with -target, empty picks XP for the architecture of each binary
+var targetName string
+
+// Windows version the binaries are patched for
+var targetVersion = osVersion{5, 1}
+
+// Architecture and profile name of the binary being patched, for mapping sections limited
+// with Arch= and Targets=
+var targetArch, targetProfileName string
+
+// findTarget looks up a profile by name
+func findTarget(name string) (targetProfile, bool) {
+	for _, profile := range targetProfiles {
+		if strings.EqualFold(profile.Name, name) {
+			return profile, true
+		}
+	}
+	return targetProfile{}, false
+}
+
+// targetNames lists the profile names for error messages and flag help
+func targetNames() string {
+	var names []string
+	for _, profile := range targetProfiles {
+		names = append(names, profile.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// resolveTarget returns the profile a binary of the given architecture is patched for,
+// refusing releases that never existed for that architecture
+func resolveTarget(arch string) (targetProfile, error) {
+	name := targetName
+	if name == "" {
+		name = "xp"
+		if arch == "x86_64" {
+			name = "xp64"
+		}
+	}
+	profile, ok := findTarget(name)
+	if !ok {
+		return targetProfile{}, fmt.Errorf("unknown target %q (available: %s)", name, targetNames())
+	}
+	for _, a := range profile.Archs {
+		if a == arch {
+			return profile, nil
+		}
+	}
+	return targetProfile{}, fmt.Errorf("%s (%s) does not exist for %s", profile.Title, profile.Version, arch)
+}
+
+// Only redirect DLLs that import at least one function missing on the target
+var minimalRedirect bool
+
+// DLLs that do not exist at all before the given version
+var dllAdditions = map[string]osVersion{
+	"bcrypt.dll":           vista,
+	"ncrypt.dll":           vista,
+	"ktmw32.dll":           vista,
+	"propsys.dll":          vista,
+	"dwmapi.dll":           vista,
+	"dxgi.dll":             vista,
+	"wevtapi.dll":          vista,
+	"bcryptprimitives.dll": win7,
+	"vcruntime140_1.dll":   win7,
+}
+
+// Prefixes of API set contract names, which the loader only understands from Windows 7 on
+var apiSetPrefixes = []string{"api-ms-win-", "ext-ms-win-"}
+
+// Functions added after Windows XP to the DLLs progwrp replaces, with the version that introduced them.
+// The list covers what progwrp implements; capture an export database with exportdb for an exact answer.
+var apiAdditions = []struct {
+	version osVersion
+	dll     string
+	names   string
+}{
+	{winXP64, "kernel32.dll", `GetProcessIdOfThread GetThreadId ReOpenFile`},
+	{vista, "kernel32.dll", `AcquireSRWLockExclusive AcquireSRWLockShared ReleaseSRWLockExclusive
+		ReleaseSRWLockShared InitializeSRWLock InitializeConditionVariable SleepConditionVariableCS
+		SleepConditionVariableSRW WakeConditionVariable WakeAllConditionVariable InitOnceBeginInitialize
+		InitOnceComplete InitOnceExecuteOnce InitOnceInitialize GetTickCount64 CreateEventExA CreateEventExW
+		CreateMutexExA CreateMutexExW CreateSemaphoreExA CreateSemaphoreExW CreateWaitableTimerExA
+		CreateWaitableTimerExW GetFinalPathNameByHandleA GetFinalPathNameByHandleW
+		GetFileInformationByHandleEx SetFileInformationByHandle QueryFullProcessImageNameA
+		QueryFullProcessImageNameW InitializeCriticalSectionEx GetLocaleInfoEx GetUserDefaultLocaleName
+		GetSystemDefaultLocaleName LCIDToLocaleName LocaleNameToLCID LCMapStringEx CompareStringEx
+		CompareStringOrdinal GetDateFormatEx GetTimeFormatEx GetNumberFormatEx GetCurrencyFormatEx
+		EnumSystemLocalesEx GetCalendarInfoEx IsValidLocaleName GetUserPreferredUILanguages
+		GetThreadPreferredUILanguages SetThreadPreferredUILanguages GetProcessPreferredUILanguages
+		SetProcessPreferredUILanguages GetSystemPreferredUILanguages GetFileMUIPath GetFileMUIInfo
+		CancelIoEx CancelSynchronousIo GetQueuedCompletionStatusEx SetFileCompletionNotificationModes
+		CreateThreadpoolWork SubmitThreadpoolWork CloseThreadpoolWork WaitForThreadpoolWorkCallbacks
+		CreateThreadpoolTimer SetThreadpoolTimer CloseThreadpoolTimer WaitForThreadpoolTimerCallbacks
+		IsThreadpoolTimerSet CreateThreadpoolWait SetThreadpoolWait CloseThreadpoolWait
+		WaitForThreadpoolWaitCallbacks CreateThreadpoolIo StartThreadpoolIo CancelThreadpoolIo
+		CloseThreadpoolIo WaitForThreadpoolIoCallbacks CreateThreadpool CloseThreadpool
+		SetThreadpoolThreadMaximum SetThreadpoolThreadMinimum CreateThreadpoolCleanupGroup
+		CloseThreadpoolCleanupGroup CloseThreadpoolCleanupGroupMembers TrySubmitThreadpoolCallback
+		CallbackMayRunLong FreeLibraryWhenCallbackReturns LeaveCriticalSectionWhenCallbackReturns
+		ReleaseMutexWhenCallbackReturns ReleaseSemaphoreWhenCallbackReturns SetEventWhenCallbackReturns
+		DisassociateCurrentThreadFromCallback FlushProcessWriteBuffers GetCurrentProcessorNumber
+		CreateSymbolicLinkA CreateSymbolicLinkW GetProductInfo GetErrorMode RegisterApplicationRestart
+		UnregisterApplicationRestart RegisterApplicationRecoveryCallback ApplicationRecoveryInProgress
+		ApplicationRecoveryFinished GetNamedPipeClientProcessId GetNamedPipeServerProcessId OpenFileById
+		QueryProcessCycleTime QueryThreadCycleTime QueryIdleProcessorCycleTime GetVolumeInformationByHandleW
+		FindFirstStreamW FindNextStreamW GetDynamicTimeZoneInformation SetDynamicTimeZoneInformation
+		GetTimeZoneInformationForYear InitializeProcThreadAttributeList UpdateProcThreadAttribute
+		DeleteProcThreadAttributeList IdnToAscii IdnToUnicode NormalizeString IsNormalizedString
+		SetFileIoOverlappedRange`},
+	{win7, "kernel32.dll", `GetLogicalProcessorInformationEx GetActiveProcessorCount
+		GetActiveProcessorGroupCount GetMaximumProcessorCount GetMaximumProcessorGroupCount
+		GetThreadGroupAffinity SetThreadGroupAffinity GetProcessGroupAffinity GetCurrentProcessorNumberEx
+		GetNumaNodeProcessorMaskEx TryAcquireSRWLockExclusive TryAcquireSRWLockShared SetThreadErrorMode
+		GetThreadErrorMode ResolveLocaleName CreateRemoteThreadEx QueryUnbiasedInterruptTime
+		SetSearchPathMode PowerCreateRequest PowerSetRequest PowerClearRequest WerRegisterRuntimeExceptionModule
+		RaiseFailFastException SetWaitableTimerEx K32EnumProcesses K32EnumProcessModules
+		K32EnumProcessModulesEx K32GetModuleBaseNameA K32GetModuleBaseNameW K32GetModuleFileNameExA
+		K32GetModuleFileNameExW K32GetModuleInformation K32GetProcessImageFileNameA
+		K32GetProcessImageFileNameW K32GetProcessMemoryInfo K32GetMappedFileNameW K32QueryWorkingSet
+		K32QueryWorkingSetEx K32GetPerformanceInfo`},
+	{win8, "kernel32.dll", `GetSystemTimePreciseAsFileTime CreateFile2 GetCurrentThreadStackLimits
+		PrefetchVirtualMemory GetOverlappedResultEx CopyFile2 SetDefaultDllDirectories AddDllDirectory
+		RemoveDllDirectory GetProcessMitigationPolicy SetProcessMitigationPolicy GetFirmwareType
+		GetCurrentPackageId GetCurrentPackageFullName GetCurrentPackageFamilyName GetPackageFullName
+		GetPackageFamilyName GetCurrentApplicationUserModelId GetApplicationUserModelId
+		SetThreadInformation GetThreadInformation GetProcessInformation SetProcessInformation`},
+	{win81, "kernel32.dll", `DiscardVirtualMemory OfferVirtualMemory ReclaimVirtualMemory`},
+	{win10, "kernel32.dll", `SetThreadDescription GetThreadDescription GetSystemCpuSetInformation
+		IsWow64Process2`},
+
+	{winXP64, "advapi32.dll", `RegGetValueA RegGetValueW RegDeleteKeyExA RegDeleteKeyExW
+		RegDisableReflectionKey RegEnableReflectionKey RegQueryReflectionKey`},
+	{vista, "advapi32.dll", `RegDeleteTreeA RegDeleteTreeW RegCopyTreeA RegCopyTreeW RegSetKeyValueA
+		RegSetKeyValueW RegDeleteKeyValueA RegDeleteKeyValueW RegLoadMUIStringA RegLoadMUIStringW
+		RegOpenKeyTransactedW RegCreateKeyTransactedW EventRegister EventUnregister EventWrite
+		EventWriteString EventEnabled EventProviderEnabled EventWriteTransfer EventActivityIdControl
+		AddMandatoryAce TreeSetNamedSecurityInfoW TreeResetNamedSecurityInfoW ControlServiceExW
+		NotifyServiceStatusChangeW OpenThreadWaitChainSession CloseThreadWaitChainSession
+		GetThreadWaitChain`},
+	{win7, "advapi32.dll", `EventWriteEx QueryServiceDynamicInformation`},
+	{win8, "advapi32.dll", `EventSetInformation EnumDynamicTimeZoneInformation`},
+
+	{vista, "user32.dll", `SetProcessDPIAware IsProcessDPIAware ChangeWindowMessageFilter
+		AddClipboardFormatListener RemoveClipboardFormatListener GetUpdatedClipboardFormats
+		ShutdownBlockReasonCreate ShutdownBlockReasonDestroy ShutdownBlockReasonQuery
+		RegisterPowerSettingNotification UnregisterPowerSettingNotification LogicalToPhysicalPoint
+		PhysicalToLogicalPoint WindowFromPhysicalPoint UpdateLayeredWindowIndirect`},
+	{win7, "user32.dll", `CalculatePopupWindowPosition SetWindowDisplayAffinity GetWindowDisplayAffinity
+		ChangeWindowMessageFilterEx RegisterTouchWindow UnregisterTouchWindow IsTouchWindow
+		GetTouchInputInfo CloseTouchInputHandle GetGestureInfo CloseGestureInfoHandle SetGestureConfig
+		GetGestureConfig GetGestureExtraArgs GetDisplayConfigBufferSizes QueryDisplayConfig
+		SetDisplayConfig DisplayConfigGetDeviceInfo DisplayConfigSetDeviceInfo`},
+	{win8, "user32.dll", `RegisterPointerInputTarget GetPointerInfo GetPointerType GetPointerFrameInfo
+		GetPointerPenInfo GetPointerTouchInfo EnableMouseInPointer IsMouseInPointerEnabled
+		SkipPointerFrameMessages GetPointerDevices GetPointerDeviceRects RegisterTouchHitTestingWindow
+		EvaluateProximityToRect GetCurrentInputMessageSource GetCIMSSM SetCoalescableTimer
+		IsImmersiveProcess`},
+	{win81, "user32.dll", `LogicalToPhysicalPointForPerMonitorDPI PhysicalToLogicalPointForPerMonitorDPI`},
+	{win10, "user32.dll", `GetDpiForWindow GetDpiForSystem AdjustWindowRectExForDpi GetSystemMetricsForDpi
+		SystemParametersInfoForDpi EnableNonClientDpiScaling SetThreadDpiAwarenessContext
+		GetThreadDpiAwarenessContext GetWindowDpiAwarenessContext GetAwarenessFromDpiAwarenessContext
+		AreDpiAwarenessContextsEqual IsValidDpiAwarenessContext SetProcessDpiAwarenessContext
+		GetDpiFromDpiAwarenessContext`},
+
+	{vista, "ntdll.dll", `RtlAcquireSRWLockExclusive RtlAcquireSRWLockShared RtlReleaseSRWLockExclusive
+		RtlReleaseSRWLockShared RtlInitializeSRWLock RtlInitializeConditionVariable
+		RtlSleepConditionVariableCS RtlSleepConditionVariableSRW RtlWakeConditionVariable
+		RtlWakeAllConditionVariable RtlRunOnceInitialize RtlRunOnceBeginInitialize RtlRunOnceComplete
+		RtlRunOnceExecuteOnce NtCreateUserProcess NtCreateThreadEx LdrRegisterDllNotification
+		LdrUnregisterDllNotification EtwEventRegister EtwEventUnregister EtwEventWrite EtwEventEnabled`},
+	{win7, "ntdll.dll", `RtlTryAcquireSRWLockExclusive RtlTryAcquireSRWLockShared
+		RtlGetCurrentProcessorNumberEx RtlQueryPerformanceCounter`},
+	{win8, "ntdll.dll", `RtlGetSystemTimePrecise RtlWaitOnAddress RtlWakeAddressSingle RtlWakeAddressAll
+		RtlAddGrowableFunctionTable RtlDeleteGrowableFunctionTable RtlGrowFunctionTable`},
+
+	{vista, "ws2_32.dll", `inet_pton inet_ntop InetPtonW InetNtopW WSAPoll GetAddrInfoExA GetAddrInfoExW
+		FreeAddrInfoEx FreeAddrInfoExW SetAddrInfoExW WSASendMsg WSAConnectByNameW WSAConnectByList`},
+	{win8, "ws2_32.dll", `GetAddrInfoExCancel GetAddrInfoExOverlappedResult`},
+
+	{vista, "shell32.dll", `SHGetKnownFolderPath SHGetKnownFolderIDList SHSetKnownFolderPath
+		SHCreateItemFromParsingName SHCreateItemFromIDList SHCreateItemWithParent SHGetIDListFromObject
+		SHGetItemFromObject SHGetNameFromIDList SHCreateShellItemArrayFromIDLists SHCreateShellItemArray
+		SHCreateShellItemArrayFromShellItem SHCreateItemFromRelativeName SHGetPropertyStoreFromParsingName
+		SHGetStockIconInfo SHOpenWithDialog SHEvaluateSystemCommandTemplate SHCreateAssociationRegistration
+		SHGetDriveMedia SHAssocEnumHandlers SHQueryUserNotificationState SHBindToFolderIDListParent
+		SHBindToObject SHGetLocalizedName SHGetFolderPathEx SHCreateDataObject`},
+	{win7, "shell32.dll", `SHGetKnownFolderItem SHCreateItemInKnownFolder SetCurrentProcessExplicitAppUserModelID
+		GetCurrentProcessExplicitAppUserModelID SHGetPropertyStoreForWindow Shell_NotifyIconGetRect
+		SHAddDefaultPropertiesByExt SHCreateDefaultPropertiesOp SHGetTemporaryPropertyForItem
+		SHSetTemporaryPropertyForItem SHAssocEnumHandlersForProtocolByApplication`},
+
+	{vista, "iphlpapi.dll", `GetIfTable2 GetIfTable2Ex FreeMibTable GetIfEntry2 GetIpInterfaceEntry
+		GetUnicastIpAddressTable GetAnycastIpAddressTable GetIpForwardTable2 GetIpNetTable2 GetBestRoute2
+		ConvertInterfaceLuidToIndex ConvertInterfaceIndexToLuid ConvertInterfaceLuidToNameW
+		ConvertInterfaceNameToLuidW ConvertInterfaceLuidToGuid ConvertLengthToIpv4Mask
+		ConvertIpv4MaskToLength NotifyIpInterfaceChange NotifyUnicastIpAddressChange NotifyRouteChange2
+		NotifyStableUnicastIpAddressTable CancelMibChangeNotify2 ResolveIpNetEntry2 GetIfStackTable
+		if_nametoindex if_indextoname GetTcp6Table GetTcp6Table2 GetTcpTable2 GetUdp6Table`},
+
+	{winXP64, "crypt32.dll", `CryptProtectMemory CryptUnprotectMemory`},
+	{vista, "crypt32.dll", `CryptHashCertificate2 CryptImportPublicKeyInfoEx2
+		CryptExportPublicKeyInfoFromBCryptKeyHandle`},
+	{win7, "crypt32.dll", `CertSelectCertificateChains`},
+
+	{win8, "winhttp.dll", `WinHttpCreateProxyResolver WinHttpGetProxyForUrlEx WinHttpGetProxyResult
+		WinHttpFreeProxyResult WinHttpResetAutoProxy WinHttpWebSocketCompleteUpgrade WinHttpWebSocketSend
+		WinHttpWebSocketReceive WinHttpWebSocketClose WinHttpWebSocketQueryCloseStatus
+		WinHttpWebSocketShutdown`},
+
+	{win8, "userenv.dll", `CreateAppContainerProfile DeleteAppContainerProfile
+		DeriveAppContainerSidFromAppContainerName GetAppContainerFolderPath GetAppContainerRegistryLocation`},
+
+	{win7, "ole32.dll", `CoGetApartmentType`},
+	{win8, "ole32.dll", `CoIncrementMTAUsage CoDecrementMTAUsage CoWaitForMultipleObjects`},
+
+	{vista, "setupapi.dll", `SetupDiGetDevicePropertyW SetupDiSetDevicePropertyW SetupDiGetDevicePropertyKeys
+		SetupDiGetClassPropertyW SetupDiGetDeviceInterfacePropertyW`},
+
+	{win8, "dnsapi.dll", `DnsQueryEx DnsCancelQuery`},
+
+	{win7, "dxgi.dll", `CreateDXGIFactory1`},
+	{win81, "dxgi.dll", `CreateDXGIFactory2`},
+}
+
+// dllMissingFunctions reports whether the target lacks a DLL or any of the functions listed for it.
+// DLLs the bundled lists know nothing about are assumed to need progwrp.
+func dllMissingFunctions(dll string) bool {
+	if isAPISet(dll) {
+		return targetVersion.before(win7)
+	}
+	lower := strings.ToLower(dll)
+	version, known := dllAdditions[lower]
+	if known && targetVersion.before(version) {
+		return true
+	}
+	functions, listed := apiIntroduced[lower]
+	for _, introduced := range functions {
+		if targetVersion.before(introduced) {
+			return true
+		}
+	}
+	return !known && !listed
+}
+
+// replacementFor returns the progwrp DLL an import is redirected to, skipping DLLs complete on the target
+func replacementFor(dll string) (string, bool) {
+	_, replacement, ok := mappingSection(dll)
+	if !ok || !dllMissingFunctions(dll) {
+		return "", false
+	}
+	return replacement, true
+}
+
+// Version that introduced each listed function, keyed by lowercase DLL name
+var apiIntroduced = make(map[string]map[string]osVersion)
+
+func init() {
+	for _, additions := range apiAdditions {
+		functions, ok := apiIntroduced[additions.dll]
+		if !ok {
+			functions = make(map[string]osVersion)
+			apiIntroduced[additions.dll] = functions
+		}
+		for _, name := range strings.Fields(additions.names) {
+			functions[name] = additions.version
+		}
+	}
+}
+
+// missingOnTarget reports whether a function does not exist on the target OS. The export
+// database given with -db is exact, the bundled lists assume unlisted functions exist.
+func missingOnTarget(dll, function string) bool {
+	if targetExports != nil {
+		native := targetExports.lookup(dll)
+		return native == nil || native.lookup(function) == nil
+	}
+
+	lower := strings.ToLower(dll)
+	if version, ok := dllAdditions[lower]; ok && targetVersion.before(version) {
+		return true
+	}
+	if isAPISet(dll) && targetVersion.before(win7) {
+		return true
+	}
+	if version, ok := apiIntroduced[lower][function]; ok {
+		return targetVersion.before(version)
+	}
+	return false
+}
+
+// neededRedirects returns the lowercase names of mapped DLLs from which at least one imported
+// function is missing on the target, counting regular and delay-load imports together
+func neededRedirects(descs []importDescriptor) map[string]bool {
+	needed := make(map[string]bool)
+	for _, desc := range descs {
+		lower := strings.ToLower(desc.Name)
+		if _, ok := replacementFor(desc.Name); !ok || needed[lower] {
+			continue
+		}
+		for _, fn := range desc.Functions {
+			if missingOnTarget(desc.Name, importFunctionName(fn)) {
+				needed[lower] = true
+				break
+			}
+		}
+	}
+	return needed
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestMinimalKeepsNativeImports(t *testing.T) {
+	for _, is64 := range []bool{false, true} {
+		t.Run(fixtureArch(is64), func(t *testing.T) {
+			dir := newTestDir(t)
+			minimalRedirect = true
+			mapping["kernel32.dll"] = "pwrp_k32.dll"
+			targetExports = &exportDatabase{Modules: map[string]*moduleExports{
+				"kernel32.dll": newModuleExports("KERNEL32.dll", []exportEntry{
+					{Name: "GetTickCount", Ordinal: 1},
+					{Name: "Sleep", Ordinal: 2},
+				}),
+			}}
+			writeFixture(t, blobsBaseDir, fixtureArch(is64)+"/pwrp_k32.dll", fxSpec{Is64: is64, Dll: true,
+				Name: "pwrp_k32.dll", Exports: []fxExport{{Name: "GetTickCount"}, {Name: "Sleep"}, {Name: "GetTickCount64"}}})
+			native := writeFixture(t, dir, "native.exe", fxSpec{Is64: is64, BoundTo: []string{"kernel32.dll"},
+				Imports: []fxImport{{DLL: "kernel32.dll", Funcs: []string{"GetTickCount", "Sleep"}}}})
+			bindFixture(t, native)
+			original := readFixture(t, native)
+
+			if err := patchFile(native, fixtureArch(is64), false); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(readFixture(t, native), original) {
+				t.Errorf("input was changed")
+			}
+			if fileExists(patchedPath(native)) {
+				t.Errorf("%s was written for a binary whose imports all exist on the target", patchedPath(native))
+			}
+
+			// One missing function moves the whole DLL
+			needs := writeFixture(t, dir, "needs.exe", fxSpec{Is64: is64,
+				Imports: []fxImport{{DLL: "kernel32.dll", Funcs: []string{"GetTickCount", "GetTickCount64"}}}})
+			want := []string{"pwrp_k32.dll!GetTickCount", "pwrp_k32.dll!GetTickCount64"}
+			if got := fixtureImports(t, patchFixture(t, needs)); !reflect.DeepEqual(got, want) {
+				t.Errorf("imports = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestResolveTarget(t *testing.T) {
+	tests := []struct {
+		target, arch string
+		want         string // profile name, empty when refused
+	}{
+		{"", "x86", "xp"},
+		{"", "x86_64", "xp64"},
+		{"xp", "x86", "xp"},
+		{"xp", "x86_64", ""},
+		{"xp64", "x86", ""},
+		{"2003", "x86", "2003"},
+		{"Vista", "x86_64", "vista"},
+		{"win2k", "x86", ""},
+	}
+	for _, tt := range tests {
+		newTestDir(t)
+		targetName = tt.target
+		profile, err := resolveTarget(tt.arch)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("-target %q for %s: got %s, want an error", tt.target, tt.arch, profile.Name)
+			}
+			continue
+		}
+		if err != nil || profile.Name != tt.want {
+			t.Errorf("-target %q for %s: got %q, %v, want %s", tt.target, tt.arch, profile.Name, err, tt.want)
+		}
+	}
+}
+
+func TestPatchRefusesTargetWithoutArch(t *testing.T) {
+	dir := newTestDir(t)
+	targetName = "xp"
+	app := writeFixture(t, dir, "app.exe", fxSpec{Is64: true, Imports: []fxImport{
+		{DLL: "kernel32.dll", Funcs: []string{"GetTickCount"}},
+	}})
+	if err := patchFile(app, "x86_64", false); err == nil {
+		t.Fatal("patching an x86_64 binary for XP succeeded")
+	}
+}
+
+func TestTargetFiltersReplacements(t *testing.T) {
+	newTestDir(t)
+	mapping["kernel32.dll"] = "pwrp_k32.dll"
+	mapping["ktmw32.dll"] = "p_ktmw32.dll"
+	tests := []struct {
+		target string
+		want   map[string]bool // DLL -> redirected
+	}{
+		{"2003", map[string]bool{"kernel32.dll": true, "ktmw32.dll": true}},
+		// ktmw32.dll is complete on Vista, kernel32.dll still lacks later functions
+		{"vista", map[string]bool{"kernel32.dll": true, "ktmw32.dll": false}},
+	}
+	for _, tt := range tests {
+		profile, _ := findTarget(tt.target)
+		targetVersion = profile.Version
+		for dll, want := range tt.want {
+			if _, got := replacementFor(dll); got != want {
+				t.Errorf("%s on %s redirected = %v, want %v", dll, tt.target, got, want)
+			}
+		}
+	}
+}
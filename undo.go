@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Suffix of the sidecar file holding what is needed to undo a patch
+const undoRecordSuffix = ".unpatch.json"
+
+// Equal bytes between two changes below which they are stored as one
+const undoMergeGap = 8
+
+// undoRecord describes how a patched binary differs from its original. The names, versions and
+// checksum are informational; unpatch works from the sections and changes, which cover every
+// byte, and checks the result against the hash of the original.
+type undoRecord struct {
+	Original      string        `json:"original"` // file name of the original
+	SHA256        string        `json:"sha256"`
+	Size          int64         `json:"size"`
+	PatchedSHA256 string        `json:"patched_sha256"`
+	Checksum      uint32        `json:"checksum"`
+	OSVersion     string        `json:"os_version"`
+	Subsystem     string        `json:"subsystem_version"`
+	Imports       []undoImport  `json:"imports"`
+	Sections      []undoSection `json:"sections"` // appended by the patcher, removed first
+	Changes       []undoChange  `json:"changes"`  // original bytes, at offsets of the original
+}
+
+// undoImport is the original DLL name of an import descriptor
+type undoImport struct {
+	Name  string `json:"name"`
+	Delay bool   `json:"delay,omitempty"`
+}
+
+// undoSection is the raw data of a section appended by the patcher
+type undoSection struct {
+	Name   string `json:"name"`
+	Offset uint32 `json:"offset"`
+	Size   uint32 `json:"size"`
+}
+
+// undoChange is a run of bytes of the original that the patched file has different or lacks
+type undoChange struct {
+	Offset   int64  `json:"offset"`
+	Original []byte `json:"original"`
+}
+
+// undoRecordPath returns the sidecar of a patched file
+func undoRecordPath(path string) string {
+	return path + undoRecordSuffix
+}
+
+// sha256Hex returns the SHA-256 of data in hex
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// versionString reads a major/minor pair of 16 bit header fields
+func versionString(data []byte, offset uint32) string {
+	return fmt.Sprintf("%d.%d", binary.LittleEndian.Uint16(data[offset:]), binary.LittleEndian.Uint16(data[offset+2:]))
+}
+
+// appendedSections returns the sections of the patched file that the original does not have
+func appendedSections(original, patched []byte) ([]undoSection, error) {
+	ol, err := parseLayout(original)
+	if err != nil {
+		return nil, err
+	}
+	pl, err := parseLayout(patched)
+	if err != nil {
+		return nil, err
+	}
+	var sections []undoSection
+	for i := ol.numSections; i < pl.numSections; i++ {
+		s := pl.section(patched, i)
+		name := patched[pl.sectionTable+uint32(i)*40:][:8]
+		sections = append(sections, undoSection{
+			Name:   string(bytes.TrimRight(name, "\x00")),
+			Offset: s.PointerToRawData,
+			Size:   s.SizeOfRawData,
+		})
+	}
+	return sections, nil
+}
+
+// removeSections cuts the raw data of appended sections out of a patched file, which leaves
+// everything else at the offsets it has in the original
+func removeSections(data []byte, sections []undoSection) ([]byte, error) {
+	sorted := append([]undoSection(nil), sections...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Offset > sorted[j].Offset })
+	out := append([]byte(nil), data...)
+	for _, s := range sorted {
+		end := uint64(s.Offset) + uint64(s.Size)
+		if end > uint64(len(out)) {
+			return nil, fmt.Errorf("section %s at 0x%x (%d bytes) is outside the file", s.Name, s.Offset, s.Size)
+		}
+		out = append(out[:s.Offset], out[end:]...)
+	}
+	return out, nil
+}
+
+// diffOriginal lists the runs of the original that differ from the patched file with its
+// appended sections removed, including the part of the original past its end
+func diffOriginal(original, collapsed []byte) []undoChange {
+	var changes []undoChange
+	start, last := -1, -1
+	for i := range original {
+		if i < len(collapsed) && original[i] == collapsed[i] {
+			continue
+		}
+		if start >= 0 && i-last > undoMergeGap {
+			changes = append(changes, undoChange{Offset: int64(start), Original: original[start : last+1]})
+			start = -1
+		}
+		if start < 0 {
+			start = i
+		}
+		last = i
+	}
+	if start >= 0 {
+		changes = append(changes, undoChange{Offset: int64(start), Original: original[start : last+1]})
+	}
+	return changes
+}
+
+// newUndoRecord compares a patched file with its original
+func newUndoRecord(name string, original, patched []byte, descs []importDescriptor) (*undoRecord, error) {
+	l, err := parseLayout(original)
+	if err != nil {
+		return nil, err
+	}
+	sections, err := appendedSections(original, patched)
+	if err != nil {
+		return nil, err
+	}
+	collapsed, err := removeSections(patched, sections)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &undoRecord{
+		Original:      name,
+		SHA256:        sha256Hex(original),
+		Size:          int64(len(original)),
+		PatchedSHA256: sha256Hex(patched),
+		Checksum:      binary.LittleEndian.Uint32(original[l.field(checksumField):]),
+		OSVersion:     versionString(original, l.field(0x28)),
+		Subsystem:     versionString(original, l.field(0x30)),
+		Sections:      sections,
+		Changes:       diffOriginal(original, collapsed),
+	}
+	for _, desc := range descs {
+		r.Imports = append(r.Imports, undoImport{Name: desc.Name, Delay: desc.Delay})
+	}
+	return r, nil
+}
+
+// apply rebuilds the original from the patched file
+func (r *undoRecord) apply(patched []byte) ([]byte, error) {
+	if sha256Hex(patched) != r.PatchedSHA256 {
+		return nil, fmt.Errorf("file was changed after patching, or the record belongs to another file")
+	}
+	data, err := removeSections(patched, r.Sections)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > r.Size {
+		data = data[:r.Size]
+	} else {
+		data = append(data, make([]byte, r.Size-int64(len(data)))...)
+	}
+	for _, c := range r.Changes {
+		if c.Offset < 0 || c.Offset+int64(len(c.Original)) > r.Size {
+			return nil, fmt.Errorf("change at 0x%x is outside the original", c.Offset)
+		}
+		copy(data[c.Offset:], c.Original)
+	}
+	if sum := sha256Hex(data); sum != r.SHA256 {
+		return nil, fmt.Errorf("restored file has SHA-256 %s instead of %s", sum, r.SHA256)
+	}
+	return data, nil
+}
+
+// writeUndoRecord stores the sidecar of a patched file next to it
+func writeUndoRecord(path, outPath string, original []byte, descs []importDescriptor) error {
+	patched, err := os.ReadFile(outPath)
+	if err != nil {
+		return fmt.Errorf("failed to read patched file: %v", err)
+	}
+	r, err := newUndoRecord(filepath.Base(path), original, patched, descs)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode undo record: %v", err)
+	}
+	recordPath := undoRecordPath(outPath)
+	existed := fileExists(recordPath)
+	if err := os.WriteFile(recordPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write undo record: %v", err)
+	}
+	if journal != nil && !existed {
+		if err := journal.addRecord(recordPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadUndoRecord reads the sidecar of a patched file
+func loadUndoRecord(path string) (*undoRecord, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read undo record: %v", err)
+	}
+	r := &undoRecord{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("failed to decode undo record %s: %v", path, err)
+	}
+	return r, nil
+}
+
+// runUnpatch implements the unpatch command
+func runUnpatch(args []string) error {
+	fs := flag.NewFlagSet("unpatch", flag.ExitOnError)
+	input := fs.String("i", "", "patched binary")
+	recordPath := fs.String("record", "", "undo record of the binary (default the binary name + "+undoRecordSuffix+")")
+	output := fs.String("o", "", "file to write the original to (default its original name next to the binary)")
+	fs.Parse(args)
+
+	if *input == "" {
+		return fmt.Errorf("unpatch requires -i")
+	}
+	if *recordPath == "" {
+		*recordPath = undoRecordPath(*input)
+	}
+	r, err := loadUndoRecord(*recordPath)
+	if err != nil {
+		return err
+	}
+	patched, err := os.ReadFile(*input)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %v", err)
+	}
+	original, err := r.apply(patched)
+	if err != nil {
+		return fmt.Errorf("cannot unpatch %s: %v", *input, err)
+	}
+
+	if *output == "" {
+		*output = filepath.Join(filepath.Dir(*input), r.Original)
+		if strings.EqualFold(*output, *input) || fileExists(*output) {
+			return fmt.Errorf("%s already exists, choose where to write the original with -o", *output)
+		}
+	}
+	if err := os.WriteFile(*output, original, 0644); err != nil {
+		return fmt.Errorf("failed to write original: %v", err)
+	}
+
+	var names []string
+	for _, imp := range r.Imports {
+		names = append(names, imp.Name)
+	}
+	fmt.Printf("restored %s -> %s (imports %s, OS version %s, checksum 0x%08x)\n",
+		*input, *output, strings.Join(names, ", "), r.OSVersion, r.Checksum)
+	fmt.Printf("verified SHA-256 %s\n", r.SHA256)
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnpatchRoundTrip(t *testing.T) {
+	tests := []struct {
+		name        string
+		replacement string
+		spec        fxSpec
+		bind        bool
+	}{
+		{"renamed in place", "pwrp_k32.dll", fxSpec{}, false},
+		{"name in .pwrp with overlay", "progwrp_kernel32.dll", fxSpec{Overlay: []byte("overlay\x00data")}, false},
+		{"signed", "progwrp_kernel32.dll", fxSpec{Overlay: []byte("payload"), Signature: []byte("signature")}, false},
+		{"bound", "pwrp_k32.dll", fxSpec{BoundTo: []string{"kernel32.dll"}}, true},
+	}
+	for _, is64 := range []bool{false, true} {
+		for _, tt := range tests {
+			t.Run(fixtureArch(is64)+" "+tt.name, func(t *testing.T) {
+				dir := newTestDir(t)
+				mapping["kernel32.dll"] = tt.replacement
+				writeFixture(t, blobsBaseDir, fixtureArch(is64)+"/"+tt.replacement, fxSpec{Is64: is64, Dll: true,
+					Name: tt.replacement, Exports: []fxExport{{Name: "GetTickCount"}}})
+				spec := tt.spec
+				spec.Is64 = is64
+				spec.Checksum = 0x1234
+				spec.Imports = []fxImport{{DLL: "kernel32.dll", Funcs: []string{"GetTickCount"}}}
+				app := writeFixture(t, dir, "app.exe", spec)
+				if tt.bind {
+					bindFixture(t, app)
+				}
+				original := readFixture(t, app)
+
+				out := patchFixture(t, app)
+				patched := readFixture(t, out)
+				if bytes.Equal(patched, original) {
+					t.Fatal("nothing was patched")
+				}
+				r, err := loadUndoRecord(undoRecordPath(out))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if r.Original != "app.exe" || r.Checksum != 0x1234 || r.OSVersion != "6.1" {
+					t.Errorf("record = %+v", r)
+				}
+				restored, err := r.apply(patched)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(restored, original) {
+					t.Errorf("restored file differs from the original")
+				}
+			})
+		}
+	}
+}
+
+func TestUnpatchCommand(t *testing.T) {
+	dir := newTestDir(t)
+	mapping["kernel32.dll"] = "pwrp_k32.dll"
+	writeFixture(t, blobsBaseDir, "x86/pwrp_k32.dll", fxSpec{Dll: true, Name: "pwrp_k32.dll",
+		Exports: []fxExport{{Name: "GetTickCount"}}})
+	app := writeFixture(t, dir, "app.exe", fxSpec{Imports: []fxImport{{DLL: "kernel32.dll", Funcs: []string{"GetTickCount"}}}})
+	original := readFixture(t, app)
+	out := patchFixture(t, app)
+
+	// The original is still next to the patched file
+	if err := runUnpatch([]string{"-i", out}); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("runUnpatch error = %v", err)
+	}
+	restoredPath := filepath.Join(dir, "restored.exe")
+	if err := runUnpatch([]string{"-i", out, "-o", restoredPath}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readFixture(t, restoredPath), original) {
+		t.Errorf("restored file differs from the original")
+	}
+
+	patched := readFixture(t, out)
+	patched[len(patched)-1] ^= 0xff
+	if err := os.WriteFile(out, patched, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := runUnpatch([]string{"-i", out, "-o", filepath.Join(dir, "again.exe")})
+	if err == nil || !strings.Contains(err.Error(), "file was changed after patching") {
+		t.Fatalf("runUnpatch error for a changed file = %v", err)
+	}
+}